@@ -0,0 +1,181 @@
+// Package command implements the courtney command. Programs can build their
+// own courtney binary with extra exclusion rules by calling Main.
+package command
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/dave/courtney/scanner"
+	"github.com/dave/courtney/shared"
+	"github.com/dave/courtney/tester"
+	"github.com/dave/patsy"
+	"github.com/dave/patsy/vos"
+)
+
+// Main parses the command line flags and runs the command with the provided
+// extra rules. It exits the program if there's an error.
+func Main(rules ...scanner.Rule) {
+	// notest
+	env := vos.Os()
+
+	enforceFlag := flag.Bool("e", false, "Enforce 100% code coverage")
+	verboseFlag := flag.Bool("v", false, "Verbose output")
+	shortFlag := flag.Bool("short", false, "Pass the short flag to the go test command")
+	filesFlag := flag.Bool("f", false, "Show file paths not module paths")
+	timeoutFlag := flag.String("timeout", "", "Pass the timeout flag to the go test command")
+	outputFlag := flag.String("o", "", "Override coverage file location")
+	argsFlag := new(argsValue)
+	flag.Var(argsFlag, "t", "Argument to pass to the 'go test' command. Can be used more than once.")
+	loadFlag := flag.String("l", "", "Load coverage file(s) instead of running 'go test'")
+	auditFlag := flag.Bool("audit", false, "Fail if a notest comment has no reason or has expired")
+	strictFlag := flag.Bool("strict", false, "Only exclude errors returned by calls into other modules or the standard library")
+	goosFlag := flag.String("goos", "", "Platform used to evaluate runtime.GOOS comparisons (default $GOOS or the current platform)")
+	goarchFlag := flag.String("goarch", "", "Platform used to evaluate runtime.GOARCH comparisons (default $GOARCH or the current platform)")
+	configFlag := flag.String("c", "", "Config file location (default "+shared.DefaultConfig+")")
+	terminatorsFlag := new(argsValue)
+	flag.Var(terminatorsFlag, "terminator", "Extra function that ends the program e.g. k8s.io/klog/v2.Fatalf. Can be used more than once.")
+	directivesFlag := new(argsValue)
+	flag.Var(directivesFlag, "directive", "Extra spelling of the notest directive e.g. coverage:ignore. Can be used more than once.")
+	known := map[shared.Rule]bool{}
+	for rule := range shared.Defaults {
+		known[rule] = true
+	}
+	for _, rule := range rules {
+		known[rule.Name()] = true
+	}
+	enabled := map[shared.Rule]bool{}
+	flag.Var(&rulesValue{rules: enabled, known: known, enabled: true}, "enable", "Exclusion rule(s) to turn on, comma separated. Can be used more than once.")
+	flag.Var(&rulesValue{rules: enabled, known: known, enabled: false}, "disable", "Exclusion rule(s) to turn off, comma separated. Can be used more than once.")
+
+	flag.Parse()
+
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	setup := &shared.Setup{
+		Env:         env,
+		Paths:       patsy.NewCache(env),
+		Enforce:     *enforceFlag,
+		Verbose:     *verboseFlag,
+		Short:       *shortFlag,
+		Files:       *filesFlag,
+		Timeout:     *timeoutFlag,
+		Output:      *outputFlag,
+		TestArgs:    argsFlag.args,
+		Load:        *loadFlag,
+		Rules:       enabled,
+		Terminators: terminatorsFlag.args,
+		Directives:  directivesFlag.args,
+		Audit:       *auditFlag,
+		Strict:      *strictFlag,
+		GOOS:        *goosFlag,
+		GOARCH:      *goarchFlag,
+		Config:      *configFlag,
+		Explicit:    explicit,
+	}
+	if err := Run(setup, rules...); err != nil {
+		fmt.Printf("%+v", err)
+		os.Exit(1)
+	}
+}
+
+// Run initiates the command with the provided setup and extra rules
+func Run(setup *shared.Setup, rules ...scanner.Rule) error {
+	if err := setup.LoadConfig(); err != nil {
+		return errors.Wrapf(err, "LoadConfig")
+	}
+	if err := setup.Parse(flag.Args()); err != nil {
+		return errors.Wrapf(err, "Parse")
+	}
+
+	s := scanner.New(setup, rules...)
+	if err := s.LoadProgram(); err != nil {
+		return errors.Wrapf(err, "LoadProgram")
+	}
+	if err := s.ScanPackages(); err != nil {
+		return errors.Wrapf(err, "ScanPackages")
+	}
+
+	t := tester.New(setup)
+	if setup.Load == "" {
+		if err := t.Test(); err != nil {
+			return errors.Wrapf(err, "Test")
+		}
+	} else {
+		if err := t.Load(); err != nil {
+			return errors.Wrapf(err, "Load")
+		}
+	}
+	if err := t.ProcessExcludes(s.Excludes); err != nil {
+		return errors.Wrapf(err, "ProcessExcludes")
+	}
+	if err := t.Save(); err != nil {
+		return errors.Wrapf(err, "Save")
+	}
+	if err := t.Enforce(); err != nil {
+		return errors.Wrapf(err, "Enforce")
+	}
+
+	return nil
+}
+
+type argsValue struct {
+	args []string
+}
+
+var _ flag.Value = (*argsValue)(nil)
+
+func (v *argsValue) String() string {
+	// notest
+	if v == nil {
+		return ""
+	}
+	return strings.Join(v.args, " ")
+}
+func (v *argsValue) Set(s string) error {
+	// notest
+	v.args = append(v.args, s)
+	return nil
+}
+
+type rulesValue struct {
+	rules   map[shared.Rule]bool
+	known   map[shared.Rule]bool
+	enabled bool
+}
+
+var _ flag.Value = (*rulesValue)(nil)
+
+func (v *rulesValue) String() string {
+	// notest
+	if v == nil {
+		return ""
+	}
+	var names []string
+	for rule, enabled := range v.rules {
+		if enabled == v.enabled {
+			names = append(names, string(rule))
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+func (v *rulesValue) Set(s string) error {
+	// notest
+	for _, name := range strings.Split(s, ",") {
+		rule := shared.Rule(strings.TrimSpace(name))
+		if !v.known[rule] {
+			return errors.Errorf("unknown rule %q", rule)
+		}
+		v.rules[rule] = v.enabled
+	}
+	return nil
+}
@@ -1,10 +1,11 @@
-package main
+package command
 
 import (
 	"fmt"
 	"testing"
 
 	"bytes"
+	"go/ast"
 	"os"
 	"path/filepath"
 	"strings"
@@ -13,6 +14,7 @@ import (
 	"github.com/dave/patsy"
 	"github.com/dave/patsy/builder"
 	"github.com/dave/patsy/vos"
+	"golang.org/x/tools/go/packages"
 )
 
 func TestRun(t *testing.T) {
@@ -191,3 +193,81 @@ ns/a/a.go:8.24,11.5 2 1
 		})
 	}
 }
+
+// barRule is an extra rule that excludes the body of functions named Bar
+type barRule struct{}
+
+func (barRule) Name() shared.Rule { return "bar" }
+
+func (barRule) Inspect(pkg *packages.Package, file *ast.File, node ast.Node, exclude func(line int, reason string)) {
+	if decl, ok := node.(*ast.FuncDecl); ok && decl.Name.Name == "Bar" {
+		for _, stmt := range decl.Body.List {
+			exclude(pkg.Fset.Position(stmt.Pos()).Line, "")
+		}
+	}
+}
+
+func TestRun_rules(t *testing.T) {
+	name := "rules"
+	env := vos.Mock()
+	b, err := builder.New(env, "ns", true)
+	if err != nil {
+		t.Fatalf("Error creating builder in %s: %s", name, err)
+	}
+	defer b.Cleanup()
+
+	_, pdir, err := b.Package("a", map[string]string{
+		"a.go": `package a
+		
+			func Foo(i int) int {
+				i++
+				return i
+			}
+			
+			func Bar(i int) int {
+				i++
+				return i
+			}
+		`,
+		"a.out": `mode: set
+ns/a/a.go:3.24,6.5 2 1
+ns/a/a.go:8.24,11.5 2 0
+`,
+	})
+	if err != nil {
+		t.Fatalf("Error creating builder in %s: %s", name, err)
+	}
+
+	if err := env.Setwd(pdir); err != nil {
+		t.Fatalf("Error in Setwd in %s: %s", name, err)
+	}
+	if err := os.Chdir(pdir); err != nil {
+		t.Fatalf("Error in os.Chdir in %s: %s", name, err)
+	}
+
+	sout := &bytes.Buffer{}
+	serr := &bytes.Buffer{}
+	env.Setstdout(sout)
+	env.Setstderr(serr)
+
+	setup := &shared.Setup{
+		Env:     env,
+		Paths:   patsy.NewCache(env),
+		Load:    "*.out",
+		Enforce: true,
+	}
+	if err := Run(setup, barRule{}); err != nil {
+		t.Fatalf("Error running program in %s: %s", name, err)
+	}
+
+	coverage, err := os.ReadFile(filepath.Join(pdir, "coverage.out"))
+	if err != nil {
+		t.Fatalf("Error reading coverage file in %s: %s", name, err)
+	}
+	expected := `mode: set
+ns/a/a.go:3.24,6.5 2 1
+`
+	if string(coverage) != expected {
+		t.Fatalf("Error in %s coverage. Got: \n%s\nExpected: \n%s\n", name, string(coverage), expected)
+	}
+}
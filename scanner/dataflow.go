@@ -0,0 +1,478 @@
+package scanner
+
+import (
+	"go/ast"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"strings"
+
+	"github.com/dave/courtney/shared"
+	"github.com/pkg/errors"
+	"golang.org/x/tools/go/ssa"
+)
+
+// inspectDataflow builds the SSA form of the package and excludes returns of
+// zero values and an error that is provably non-nil on every path that reaches
+// them, along with the bodies of if statements that always lead to such a
+// return. This covers error paths the syntactic error rule misses e.g.
+// if err != nil { goto fail } or if err != nil { break } followed by a
+// return err after the loop.
+func (p *PackageMap) inspectDataflow() (err error) {
+	if !p.setup.Enabled(shared.RuleDataflow) {
+		return nil
+	}
+	if p.pkg.Types == nil || p.pkg.IllTyped || len(p.pkg.Errors) > 0 {
+		// the SSA builder requires well typed code
+		return nil
+	}
+
+	// add a recover to catch a panic in the SSA builder and add some context
+	// to the error
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			err = errors.Errorf("Panic building SSA for %s: %s", p.pkg.PkgPath, panicErr)
+		}
+	}()
+
+	prog := ssa.NewProgram(p.fset, 0)
+
+	// dependencies are created from type information only
+	created := map[*types.Package]bool{p.pkg.Types: true}
+	var create func(pkg *types.Package)
+	create = func(pkg *types.Package) {
+		if pkg == nil || created[pkg] {
+			return
+		}
+		created[pkg] = true
+		for _, imp := range pkg.Imports() {
+			create(imp)
+		}
+		prog.CreatePackage(pkg, nil, nil, true)
+	}
+	for _, imp := range p.pkg.Types.Imports() {
+		create(imp)
+	}
+	for _, obj := range p.pkg.TypesInfo.Uses {
+		create(obj.Pkg())
+	}
+	pkg := prog.CreatePackage(p.pkg.Types, p.pkg.Syntax, p.pkg.TypesInfo, true)
+	pkg.Build()
+
+	// if statements are found by the position of the comparisons in their
+	// condition
+	ifs := map[token.Pos]comparison{}
+	for _, file := range p.pkg.Syntax {
+		ast.Inspect(file, func(node ast.Node) bool {
+			if stmt, ok := node.(*ast.IfStmt); ok {
+				comparisons(stmt.Cond, false, func(e *ast.BinaryExpr, negated bool) {
+					ifs[e.OpPos] = comparison{stmt: stmt, negated: negated}
+				})
+			}
+			return true
+		})
+	}
+
+	var funcs []*ssa.Function
+	var add func(fn *ssa.Function)
+	add = func(fn *ssa.Function) {
+		if fn == nil {
+			return
+		}
+		funcs = append(funcs, fn)
+		for _, anon := range fn.AnonFuncs {
+			add(anon)
+		}
+	}
+	for _, file := range p.pkg.Syntax {
+		for _, decl := range file.Decls {
+			if fd, ok := decl.(*ast.FuncDecl); ok && fd.Body != nil {
+				if obj, ok := p.pkg.TypesInfo.Defs[fd.Name].(*types.Func); ok {
+					add(prog.FuncValue(obj))
+				}
+			}
+		}
+	}
+
+	for _, fn := range funcs {
+		p.inspectFunction(fn, ifs)
+	}
+	return nil
+}
+
+// comparison is an == or != comparison in the condition of an if statement
+type comparison struct {
+	stmt    *ast.IfStmt
+	negated bool // negated is true if the comparison is inside an odd number of ! operators
+}
+
+// comparisons calls f for each == or != comparison in a condition
+func comparisons(e ast.Expr, negated bool, f func(e *ast.BinaryExpr, negated bool)) {
+	switch e := e.(type) {
+	case *ast.ParenExpr:
+		comparisons(e.X, negated, f)
+	case *ast.UnaryExpr:
+		if e.Op == token.NOT {
+			comparisons(e.X, !negated, f)
+		}
+	case *ast.BinaryExpr:
+		switch e.Op {
+		case token.LAND, token.LOR:
+			comparisons(e.X, negated, f)
+			comparisons(e.Y, negated, f)
+		case token.EQL, token.NEQ:
+			f(e, negated)
+		}
+	}
+}
+
+// inspectFunction excludes the returns in a single function that return a
+// provably non-nil error, and the if / else blocks that always lead to them
+func (p *PackageMap) inspectFunction(fn *ssa.Function, ifs map[token.Pos]comparison) {
+	results := fn.Signature.Results()
+	if results.Len() == 0 || !types.Implements(results.At(results.Len()-1).Type(), errorType) {
+		return
+	}
+
+	d := &dataflow{fn: fn, visiting: map[ssa.Value]bool{}, isExternal: p.isExternal}
+
+	// doomed blocks always end in a return of a non-nil error
+	doomed := map[*ssa.BasicBlock]bool{}
+	for _, b := range fn.Blocks {
+		ret, ok := b.Instrs[len(b.Instrs)-1].(*ssa.Return)
+		if !ok || len(ret.Results) == 0 || !ret.Pos().IsValid() {
+			continue
+		}
+		err := ret.Results[len(ret.Results)-1]
+		if p.setup.Strict && !d.external(err) {
+			continue
+		}
+		if zeroResults(ret.Results[:len(ret.Results)-1]) && d.nonNilAt(err, b) {
+			doomed[b] = true
+			pos := p.fset.Position(ret.Pos())
+			p.addExclude(shared.RuleDataflow, pos.Filename, pos.Line)
+		}
+	}
+	if len(doomed) == 0 {
+		return
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, b := range fn.Blocks {
+			if doomed[b] || len(b.Succs) == 0 {
+				continue
+			}
+			all := true
+			for _, s := range b.Succs {
+				if !doomed[s] {
+					all = false
+					break
+				}
+			}
+			if all {
+				doomed[b] = true
+				changed = true
+			}
+		}
+	}
+
+	// each block is excluded when the branch of the if statement that leads
+	// to it always ends in a doomed block. Jump threading means the branch of
+	// the SSA if instruction can't be matched to the block by its comment.
+	for _, b := range fn.Blocks {
+		cond, ok := b.Instrs[len(b.Instrs)-1].(*ssa.If)
+		if !ok {
+			continue
+		}
+		c, ok := ifs[cond.Cond.Pos()]
+		if !ok {
+			continue
+		}
+		then, els := b.Succs[0], b.Succs[1]
+		if c.negated {
+			then, els = els, then
+		}
+		if doomed[then] {
+			if body := c.stmt.Body.List; len(body) > 0 {
+				p.excludeRange(shared.RuleDataflow, body[0].Pos(), body[len(body)-1].End())
+			}
+		}
+		if doomed[els] {
+			p.excludeElse(shared.RuleDataflow, c.stmt.Else)
+		}
+	}
+}
+
+// zeroResults returns true if every value is a zero constant, so only the
+// error is returned e.g. return 0, nil, err
+func zeroResults(values []ssa.Value) bool {
+	for _, v := range values {
+		c, ok := v.(*ssa.Const)
+		if !ok {
+			return false
+		}
+		if c.Value == nil {
+			// the zero value of the type
+			continue
+		}
+		switch c.Value.Kind() {
+		case constant.Bool:
+			if constant.BoolVal(c.Value) {
+				return false
+			}
+		case constant.String:
+			if constant.StringVal(c.Value) != "" {
+				return false
+			}
+		case constant.Int, constant.Float, constant.Complex:
+			if constant.Sign(c.Value) != 0 {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// dataflow proves error values in a function to be non-nil. A value is
+// non-nil when it has been compared with nil on every path that reaches it,
+// or when it wraps a value that has.
+type dataflow struct {
+	fn         *ssa.Function
+	visiting   map[ssa.Value]bool
+	isExternal func(pkg *types.Package) bool
+}
+
+// nonNilAt returns true if the value is non-nil on every path that reaches
+// the end of the block
+func (d *dataflow) nonNilAt(v ssa.Value, b *ssa.BasicBlock) bool {
+	if instr, ok := v.(ssa.Instruction); ok && instr.Block() == b {
+		return d.nonNil(v)
+	}
+	return d.nonNilEntry(v, b)
+}
+
+// nonNilEntry returns true if the value is non-nil on every path that reaches
+// the start of the block. This is a must analysis over the control flow graph,
+// so all blocks start as true and are cleared until nothing changes.
+func (d *dataflow) nonNilEntry(v ssa.Value, block *ssa.BasicBlock) bool {
+	var defined *ssa.BasicBlock
+	if instr, ok := v.(ssa.Instruction); ok {
+		defined = instr.Block()
+	}
+	var value, evaluated bool
+	in := map[*ssa.BasicBlock]bool{}
+	for _, b := range d.fn.Blocks {
+		in[b] = len(b.Preds) > 0
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, b := range d.fn.Blocks {
+			if !in[b] {
+				continue
+			}
+			for _, pred := range b.Preds {
+				if compared(v, pred, b) {
+					continue
+				}
+				if pred == defined {
+					if !evaluated {
+						value, evaluated = d.nonNil(v), true
+					}
+					if value {
+						continue
+					}
+				} else if in[pred] && b != defined {
+					continue
+				}
+				in[b] = false
+				changed = true
+				break
+			}
+		}
+	}
+	return in[block]
+}
+
+// nonNil returns true if the value is non-nil where it is defined
+func (d *dataflow) nonNil(v ssa.Value) bool {
+	if d.visiting[v] {
+		// a value that depends on itself through a loop is non-nil if all the
+		// values entering the loop are non-nil
+		return true
+	}
+	d.visiting[v] = true
+	defer delete(d.visiting, v)
+
+	switch v := v.(type) {
+	case *ssa.Phi:
+		for i, edge := range v.Edges {
+			pred := v.Block().Preds[i]
+			if !compared(edge, pred, v.Block()) && !d.nonNilAt(edge, pred) {
+				return false
+			}
+		}
+		return true
+	case *ssa.MakeInterface:
+		return d.nonNil(v.X)
+	case *ssa.ChangeInterface:
+		return d.nonNil(v.X)
+	case *ssa.ChangeType:
+		return d.nonNil(v.X)
+	case *ssa.Call:
+		// a call to a known wrapper e.g. errors.Wrap(err, "...") or
+		// fmt.Errorf("...: %w", err) is non-nil if the error it wraps is
+		if !isWrapper(&v.Call) {
+			return false
+		}
+		for _, arg := range arguments(v.Call.Args) {
+			if !types.Implements(arg.Type(), errorType) {
+				continue
+			}
+			if d.nonNilAt(arg, v.Block()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// external returns true if the value was returned by a call into another
+// module or the standard library, for the strict option. A call that wraps an
+// error is external if the error it wraps is.
+func (d *dataflow) external(v ssa.Value) bool {
+	if d.visiting[v] {
+		return true
+	}
+	d.visiting[v] = true
+	defer delete(d.visiting, v)
+
+	switch v := v.(type) {
+	case *ssa.Phi:
+		for _, edge := range v.Edges {
+			if !d.external(edge) {
+				return false
+			}
+		}
+		return true
+	case *ssa.MakeInterface:
+		return d.external(v.X)
+	case *ssa.ChangeInterface:
+		return d.external(v.X)
+	case *ssa.ChangeType:
+		return d.external(v.X)
+	case *ssa.Extract:
+		return d.external(v.Tuple)
+	case *ssa.Call:
+		if isWrapper(&v.Call) {
+			for _, arg := range arguments(v.Call.Args) {
+				if types.Implements(arg.Type(), errorType) && d.external(arg) {
+					return true
+				}
+			}
+			return false
+		}
+		if v.Call.IsInvoke() {
+			return d.isExternal(v.Call.Method.Pkg())
+		}
+		if fn := v.Call.StaticCallee(); fn != nil && fn.Object() != nil {
+			return d.isExternal(fn.Object().Pkg())
+		}
+	}
+	return false
+}
+
+// wrappers lists the functions that return a non-nil error when an error
+// passed to them is non-nil, in the form returned by types.Func.FullName
+var wrappers = map[string]bool{
+	"errors.Join":                        true,
+	"github.com/pkg/errors.Wrap":         true,
+	"github.com/pkg/errors.Wrapf":        true,
+	"github.com/pkg/errors.WithStack":    true,
+	"github.com/pkg/errors.WithMessage":  true,
+	"github.com/pkg/errors.WithMessagef": true,
+}
+
+// isWrapper returns true if the call is to one of the wrappers, or to
+// fmt.Errorf with a %w verb in its format
+func isWrapper(call *ssa.CallCommon) bool {
+	fn := call.StaticCallee()
+	if fn == nil {
+		return false
+	}
+	obj, ok := fn.Object().(*types.Func)
+	if !ok {
+		return false
+	}
+	if obj.FullName() == "fmt.Errorf" && len(call.Args) > 0 {
+		format, ok := call.Args[0].(*ssa.Const)
+		return ok && format.Value != nil && format.Value.Kind() == constant.String &&
+			strings.Contains(constant.StringVal(format.Value), "%w")
+	}
+	return wrappers[obj.FullName()]
+}
+
+// arguments returns the arguments of a call, including the values stored in
+// a variadic slice. Arguments converted to another interface e.g. any are
+// returned before the conversion.
+func arguments(args []ssa.Value) []ssa.Value {
+	var out []ssa.Value
+	add := func(v ssa.Value) {
+		if ci, ok := v.(*ssa.ChangeInterface); ok {
+			v = ci.X
+		}
+		out = append(out, v)
+	}
+	for _, arg := range args {
+		slice, ok := arg.(*ssa.Slice)
+		if !ok {
+			add(arg)
+			continue
+		}
+		alloc, ok := slice.X.(*ssa.Alloc)
+		if !ok {
+			continue
+		}
+		for _, ref := range *alloc.Referrers() {
+			addr, ok := ref.(*ssa.IndexAddr)
+			if !ok {
+				continue
+			}
+			for _, ref := range *addr.Referrers() {
+				if store, ok := ref.(*ssa.Store); ok && store.Addr == addr {
+					add(store.Val)
+				}
+			}
+		}
+	}
+	return out
+}
+
+// compared returns true if the edge from pred to b is only taken when the
+// value is not nil e.g. if v != nil { b } or if v == nil { ... } else { b }
+func compared(v ssa.Value, pred, b *ssa.BasicBlock) bool {
+	cond, ok := pred.Instrs[len(pred.Instrs)-1].(*ssa.If)
+	if !ok || pred.Succs[0] == pred.Succs[1] {
+		return false
+	}
+	op, ok := cond.Cond.(*ssa.BinOp)
+	if !ok {
+		return false
+	}
+	if !(op.X == v && isNilConst(op.Y) || op.Y == v && isNilConst(op.X)) {
+		return false
+	}
+	switch {
+	case op.Op == token.NEQ:
+		return pred.Succs[0] == b
+	case op.Op == token.EQL:
+		return pred.Succs[1] == b
+	}
+	return false
+}
+
+func isNilConst(v ssa.Value) bool {
+	c, ok := v.(*ssa.Const)
+	return ok && c.IsNil()
+}
@@ -0,0 +1,229 @@
+package scanner
+
+import (
+	"go/ast"
+	"go/parser"
+	goscanner "go/scanner"
+	"go/token"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/dave/courtney/shared"
+	"github.com/pkg/errors"
+)
+
+// pattern is a parsed exclusion pattern. Exactly one of expr and stmts is set.
+type pattern struct {
+	expr  ast.Expr
+	stmts []ast.Stmt
+}
+
+// wildcardPrefix replaces the $ of a wildcard so the pattern can be parsed as
+// Go code
+const wildcardPrefix = "courtney_wildcard_"
+
+var wildcardRegex = regexp.MustCompile(`\$(\w+)`)
+
+// parsePattern parses Go code with $name wildcards. Each wildcard matches any
+// expression. A wildcard used more than once must match the same expression
+// each time, except $_ which matches anything.
+func parsePattern(src string) (pattern, error) {
+	src = replaceWildcards(src)
+	if expr, err := parser.ParseExpr(src); err == nil {
+		if id, ok := expr.(*ast.Ident); ok && strings.HasPrefix(id.Name, wildcardPrefix) {
+			return pattern{}, errors.New("pattern is a single wildcard, which matches every expression")
+		}
+		return pattern{expr: expr}, nil
+	}
+	f, err := parser.ParseFile(token.NewFileSet(), "", "package p; func _() {\n"+src+"\n}", 0)
+	if err != nil {
+		return pattern{}, errors.WithStack(err)
+	}
+	body := f.Decls[0].(*ast.FuncDecl).Body
+	if len(body.List) == 0 {
+		return pattern{}, errors.New("pattern is empty")
+	}
+	return pattern{stmts: body.List}, nil
+}
+
+// replaceWildcards replaces the $ of each wildcard, except inside string and
+// character literals e.g. log.Print("$x") matches the literal "$x"
+func replaceWildcards(src string) string {
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(src))
+	var s goscanner.Scanner
+	s.Init(file, []byte(src), nil, 0)
+	var out strings.Builder
+	var last int
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if tok != token.STRING && tok != token.CHAR {
+			continue
+		}
+		start := file.Offset(pos)
+		out.WriteString(wildcardRegex.ReplaceAllString(src[last:start], wildcardPrefix+"$1"))
+		out.WriteString(src[start : start+len(lit)])
+		last = start + len(lit)
+	}
+	out.WriteString(wildcardRegex.ReplaceAllString(src[last:], wildcardPrefix+"$1"))
+	return out.String()
+}
+
+// inspectPatterns excludes code that matches one of the configured patterns.
+// Expressions are excluded by their lines, and statements by their lines
+// except for the header of an if statement, so the block before it isn't
+// excluded.
+func (f *FileMap) inspectPatterns() {
+	if len(f.patterns) == 0 {
+		return
+	}
+	ast.Inspect(f.file, func(node ast.Node) bool {
+		var list []ast.Stmt
+		switch n := node.(type) {
+		case ast.Expr:
+			for _, p := range f.patterns {
+				if p.expr != nil && f.matchPattern(p.expr, n, map[string]ast.Expr{}) {
+					f.excludeRange(shared.RulePattern, n.Pos(), n.End())
+				}
+			}
+			return true
+		case *ast.BlockStmt:
+			list = n.List
+		case *ast.CaseClause:
+			list = n.Body
+		case *ast.CommClause:
+			list = n.Body
+		default:
+			return true
+		}
+		for _, p := range f.patterns {
+			if p.stmts == nil {
+				continue
+			}
+			for i := 0; i+len(p.stmts) <= len(list); i++ {
+				if !f.matchStmts(p.stmts, list[i:i+len(p.stmts)]) {
+					continue
+				}
+				for _, s := range list[i : i+len(p.stmts)] {
+					f.excludeStmt(s)
+				}
+			}
+		}
+		return true
+	})
+}
+
+func (f *FileMap) matchStmts(pattern, list []ast.Stmt) bool {
+	bindings := map[string]ast.Expr{}
+	for i, s := range pattern {
+		if !f.matchPattern(s, list[i], bindings) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *FileMap) excludeStmt(s ast.Stmt) {
+	stmt, ok := s.(*ast.IfStmt)
+	if !ok {
+		f.excludeRange(shared.RulePattern, s.Pos(), s.End())
+		return
+	}
+	if body := stmt.Body.List; len(body) > 0 {
+		f.excludeRange(shared.RulePattern, body[0].Pos(), body[len(body)-1].End())
+	}
+	if stmt.Else != nil {
+		f.excludeElse(shared.RulePattern, stmt.Else)
+	}
+}
+
+var (
+	posType      = reflect.TypeOf(token.NoPos)
+	objectType   = reflect.TypeOf((*ast.Object)(nil))
+	scopeType    = reflect.TypeOf((*ast.Scope)(nil))
+	commentsType = reflect.TypeOf((*ast.CommentGroup)(nil))
+)
+
+// matchPattern compares a node from a pattern with a node from the file,
+// ignoring positions and comments. Identifiers in the pattern are compared by
+// name because the pattern has no type information, but a wildcard used more
+// than once is compared using the type information of the file.
+func (f *FileMap) matchPattern(pattern, node ast.Node, bindings map[string]ast.Expr) bool {
+	if id, ok := pattern.(*ast.Ident); ok && strings.HasPrefix(id.Name, wildcardPrefix) {
+		expr, ok := node.(ast.Expr)
+		if !ok {
+			return false
+		}
+		name := strings.TrimPrefix(id.Name, wildcardPrefix)
+		if name == "_" {
+			return true
+		}
+		if bound, ok := bindings[name]; ok {
+			return f.matcher.Match(bound, expr)
+		}
+		bindings[name] = expr
+		return true
+	}
+	a, b := reflect.ValueOf(pattern), reflect.ValueOf(node)
+	if a.Type() != b.Type() {
+		return false
+	}
+	return f.matchValue(a.Elem(), b.Elem(), bindings)
+}
+
+func (f *FileMap) matchValue(a, b reflect.Value, bindings map[string]ast.Expr) bool {
+	if a.Kind() == reflect.Interface {
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() && b.IsNil()
+		}
+		a, b = a.Elem(), b.Elem()
+	}
+	if node, ok := a.Interface().(ast.Node); ok && a.Kind() == reflect.Ptr && !a.IsNil() {
+		// nodes are compared by matchPattern so wildcards can match a node
+		// of any type
+		other, _ := b.Interface().(ast.Node)
+		return other != nil && !b.IsNil() && f.matchPattern(node, other, bindings)
+	}
+	if a.Type() != b.Type() {
+		return false
+	}
+	switch a.Type() {
+	case posType, objectType, scopeType, commentsType:
+		return true
+	}
+	switch a.Kind() {
+	case reflect.Ptr:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() && b.IsNil()
+		}
+		return f.matchValue(a.Elem(), b.Elem(), bindings)
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			if !f.matchValue(a.Field(i), b.Field(i), bindings) {
+				return false
+			}
+		}
+		return true
+	case reflect.Slice:
+		if a.Len() != b.Len() {
+			return false
+		}
+		for i := 0; i < a.Len(); i++ {
+			if !f.matchValue(a.Index(i), b.Index(i), bindings) {
+				return false
+			}
+		}
+		return true
+	case reflect.String:
+		return a.String() == b.String()
+	case reflect.Bool:
+		return a.Bool() == b.Bool()
+	case reflect.Int:
+		return a.Int() == b.Int()
+	}
+	return a.Interface() == b.Interface()
+}
@@ -0,0 +1,38 @@
+package scanner
+
+import (
+	"go/ast"
+
+	"github.com/dave/courtney/shared"
+	"golang.org/x/tools/go/packages"
+)
+
+// Rule is an exclusion rule added by a program embedding courtney (see
+// command.Main)
+type Rule interface {
+	// Name identifies the rule. It's used to turn the rule on or off, and is
+	// recorded as the reason for each line the rule excludes. It must not be
+	// the name of a built in rule or another extra rule.
+	Name() shared.Rule
+	// Inspect is called with each node of each file in the scanned packages,
+	// and calls exclude with each line of the file that should be excluded.
+	// A non-empty reason is recorded after the name of the rule.
+	Inspect(pkg *packages.Package, file *ast.File, node ast.Node, exclude func(line int, reason string))
+}
+
+// inspectRules runs the extra rules that are turned on for a single node
+func (f *FileMap) inspectRules(node ast.Node) {
+	if node == nil || len(f.rules) == 0 {
+		return
+	}
+	fpath := f.fset.File(f.file.Pos()).Name()
+	for _, rule := range f.rules {
+		if !f.setup.Enabled(rule.Name()) {
+			continue
+		}
+		name := rule.Name()
+		rule.Inspect(f.pkg, f.file, node, func(line int, reason string) {
+			f.addExcludeReason(name, reason, fpath, line)
+		})
+	}
+}
@@ -3,16 +3,22 @@ package scanner
 import (
 	"fmt"
 	"go/ast"
+	"go/build"
 	"go/constant"
 	"go/token"
 	"go/types"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/dave/astrid"
 	"github.com/dave/brenda"
 	"github.com/dave/courtney/shared"
 	"github.com/pkg/errors"
 	"golang.org/x/tools/go/packages"
+	"golang.org/x/tools/go/types/typeutil"
 )
 
 // CodeMap scans a number of packages for code to exclude
@@ -20,6 +26,18 @@ type CodeMap struct {
 	setup    *shared.Setup
 	pkgs     []*packages.Package
 	Excludes map[string]map[int]bool
+	// Reasons records the rules that excluded each line
+	Reasons map[string]map[int][]shared.Rule
+
+	terminators map[string]bool
+	directives  []string
+	sinks       map[string]bool
+	goos        string
+	goarch      string
+	hostGoos    string // the platform the packages are loaded for
+	hostGoarch  string
+	patterns    []pattern
+	rules       []Rule
 }
 
 // PackageMap scans a single package for code to exclude
@@ -34,6 +52,26 @@ type FileMap struct {
 	*PackageMap
 	file    *ast.File
 	matcher *astrid.Matcher
+	begin   *ast.Comment // the open notest:begin comment, if any
+}
+
+// terminators lists the standard library functions that end the program or
+// goroutine, in the form returned by types.Func.FullName
+var terminators = []string{
+	"log.Fatal",
+	"log.Fatalf",
+	"log.Fatalln",
+	"log.Panic",
+	"log.Panicf",
+	"log.Panicln",
+	"(*log.Logger).Fatal",
+	"(*log.Logger).Fatalf",
+	"(*log.Logger).Fatalln",
+	"(*log.Logger).Panic",
+	"(*log.Logger).Panicf",
+	"(*log.Logger).Panicln",
+	"os.Exit",
+	"runtime.Goexit",
 }
 
 type packageId struct {
@@ -41,19 +79,48 @@ type packageId struct {
 	name string
 }
 
-// New returns a CoseMap with the provided setup
-func New(setup *shared.Setup) *CodeMap {
+// New returns a CodeMap with a copy of the provided setup. The names of the
+// extra rules are added to Extra in the copy, so they can be turned on and off
+// like the built in rules.
+func New(setup *shared.Setup, rules ...Rule) *CodeMap {
+	s := *setup
+	s.Extra = append([]shared.Rule(nil), setup.Extra...)
+	for _, rule := range rules {
+		s.Extra = append(s.Extra, rule.Name())
+	}
 	return &CodeMap{
-		setup:    setup,
+		setup:    &s,
+		rules:    rules,
 		Excludes: make(map[string]map[int]bool),
+		Reasons:  make(map[string]map[int][]shared.Rule),
 	}
 }
 
-func (c *CodeMap) addExclude(fpath string, line int) {
+// addExclude excludes a line, unless the rule responsible has been turned off
+func (c *CodeMap) addExclude(rule shared.Rule, fpath string, line int) {
+	c.addExcludeReason(rule, "", fpath, line)
+}
+
+// addExcludeReason excludes a line like addExclude, and records the reason
+// given by an extra rule after the rule name e.g. "trace: debug output"
+func (c *CodeMap) addExcludeReason(rule shared.Rule, reason string, fpath string, line int) {
+	if !c.setup.Enabled(rule) {
+		return
+	}
 	if c.Excludes[fpath] == nil {
 		c.Excludes[fpath] = make(map[int]bool)
+		c.Reasons[fpath] = make(map[int][]shared.Rule)
 	}
 	c.Excludes[fpath][line] = true
+	if reason != "" {
+		rule = shared.Rule(fmt.Sprintf("%s: %s", rule, reason))
+	}
+	for _, r := range c.Reasons[fpath][line] {
+		if r == rule {
+			return
+		}
+	}
+	c.Reasons[fpath][line] = append(c.Reasons[fpath][line], rule)
 }
 
 // LoadProgram uses the loader package to load and process the source for a
@@ -72,7 +139,7 @@ func (c *CodeMap) LoadProgram() error {
 		Dir: wd,
 		Mode: packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles |
 			packages.NeedImports | packages.NeedTypes | packages.NeedTypesSizes |
-			packages.NeedSyntax | packages.NeedTypesInfo,
+			packages.NeedSyntax | packages.NeedTypesInfo | packages.NeedModule,
 		Env: c.setup.Env.Environ(),
 	}
 
@@ -104,6 +171,42 @@ func (c *CodeMap) LoadProgram() error {
 
 // ScanPackages scans the imported packages
 func (c *CodeMap) ScanPackages() error {
+	if err := c.setup.CheckRules(); err != nil {
+		return errors.WithStack(err)
+	}
+	defined := map[shared.Rule]bool{}
+	for _, rule := range c.rules {
+		if _, ok := shared.Defaults[rule.Name()]; ok || defined[rule.Name()] {
+			return errors.Errorf("rule %q is already defined", rule.Name())
+		}
+		defined[rule.Name()] = true
+	}
+	c.terminators = make(map[string]bool)
+	for _, name := range append(terminators, c.setup.Terminators...) {
+		c.terminators[name] = true
+	}
+	c.goos = c.platform(c.setup.GOOS, "GOOS", runtime.GOOS)
+	c.goarch = c.platform(c.setup.GOARCH, "GOARCH", runtime.GOARCH)
+	c.hostGoos = c.platform("", "GOOS", runtime.GOOS)
+	c.hostGoarch = c.platform("", "GOARCH", runtime.GOARCH)
+	c.sinks = make(map[string]bool)
+	for _, name := range c.setup.Sinks.Functions {
+		c.sinks[name] = true
+	}
+	c.patterns = nil
+	for _, src := range c.setup.Patterns {
+		p, err := parsePattern(src)
+		if err != nil {
+			return errors.Wrapf(err, "invalid pattern %q", src)
+		}
+		c.patterns = append(c.patterns, p)
+	}
+	// try the longest spellings first, so a spelling that starts with another
+	// spelling is matched correctly
+	c.directives = append([]string{"notest"}, c.setup.Directives...)
+	sort.SliceStable(c.directives, func(i, j int) bool {
+		return len(c.directives[i]) > len(c.directives[j])
+	})
 	for _, p := range c.pkgs {
 		pm := &PackageMap{
 			CodeMap: c,
@@ -117,10 +220,30 @@ func (c *CodeMap) ScanPackages() error {
 	return nil
 }
 
+// platform returns the configured platform value, or the value from the
+// environment, or the default
+func (c *CodeMap) platform(configured, env, def string) string {
+	if configured != "" {
+		return configured
+	}
+	if v := c.setup.Env.Getenv(env); v != "" {
+		return v
+	}
+	return def
+}
+
 // ScanPackage scans a single package
 func (p *PackageMap) ScanPackage() error {
 	for _, f := range p.pkg.Syntax {
 
+		if ast.IsGenerated(f) {
+			// exclude the whole of a generated file
+			tf := p.fset.File(f.Pos())
+			for line := 1; line <= tf.LineCount(); line++ {
+				p.addExclude(shared.RuleGenerated, tf.Name(), line)
+			}
+		}
+
 		fm := &FileMap{
 			PackageMap: p,
 			file:       f,
@@ -130,6 +253,9 @@ func (p *PackageMap) ScanPackage() error {
 			return errors.WithStack(err)
 		}
 	}
+	if err := p.inspectDataflow(); err != nil {
+		return errors.WithStack(err)
+	}
 	return nil
 }
 
@@ -139,22 +265,27 @@ func (f *FileMap) FindExcludes() error {
 
 	ast.Inspect(f.file, func(node ast.Node) bool {
 		if err != nil {
-			// notest
 			return false
 		}
 		b, inner := f.inspectNode(node)
 		if inner != nil {
-			// notest
 			err = inner
 			return false
 		}
+		f.inspectRules(node)
 		return b
 	})
 	if err != nil {
 		return errors.WithStack(err)
 	}
+	f.inspectPatterns()
 	for _, cg := range f.file.Comments {
-		f.inspectComment(cg)
+		if err := f.inspectComment(cg); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if f.begin != nil {
+		return errors.Errorf("%s: notest:begin without notest:end", f.fset.Position(f.begin.Pos()))
 	}
 	return nil
 }
@@ -181,9 +312,212 @@ func (f *FileMap) findScope(node ast.Node, filter func(ast.Node) bool) ast.Node
 	return nil
 }
 
-func (f *FileMap) inspectComment(cg *ast.CommentGroup) {
+// trailingStatement returns true if the comment follows code on the same line.
+// The statement on that line is also returned: the block if the comment
+// follows its opening brace, or the outermost statement that starts on the
+// line, or the outermost statement that ends on the line, or failing that the
+// innermost statement that contains the comment. Blocks are only returned
+// when opened on the line, so e.g. a comment after a closing brace doesn't
+// exclude the enclosing function. This is nil if the code is not part of a
+// statement.
+func (f *FileMap) trailingStatement(cm *ast.Comment) (ast.Stmt, bool) {
+	line := f.fset.Position(cm.Pos()).Line
+	var trailing bool
+	var opening, outer, ending, inner ast.Stmt
+	ast.Inspect(f.file, func(node ast.Node) bool {
+		if node == nil || node.Pos() >= cm.Pos() {
+			return false
+		}
+		switch node.(type) {
+		case *ast.Comment, *ast.CommentGroup:
+			return false
+		}
+		if node.End() <= cm.Pos() && f.fset.Position(node.End()).Line == line {
+			trailing = true
+		}
+		stmt, ok := node.(ast.Stmt)
+		if !ok {
+			return true
+		}
+		if block, ok := stmt.(*ast.BlockStmt); ok {
+			if cm.Pos() < block.Rbrace && f.fset.Position(block.Lbrace).Line == line {
+				opening = block
+			}
+			return true
+		}
+		if outer == nil && f.fset.Position(stmt.Pos()).Line == line {
+			outer = stmt
+		}
+		if ending == nil && stmt.End() <= cm.Pos() && f.fset.Position(stmt.End()).Line == line {
+			ending = stmt
+		}
+		if cm.Pos() < stmt.End() {
+			inner = stmt
+		}
+		return true
+	})
+	switch {
+	case opening != nil:
+		return opening, trailing
+	case outer != nil:
+		return outer, trailing
+	case ending != nil:
+		return ending, trailing
+	}
+	return inner, trailing
+}
+
+// codeAfter returns true if any code follows pos on the same line
+func (f *FileMap) codeAfter(pos token.Pos) bool {
+	line := f.fset.Position(pos).Line
+	var found bool
+	ast.Inspect(f.file, func(node ast.Node) bool {
+		if node == nil || found || node.End() <= pos {
+			return false
+		}
+		switch node.(type) {
+		case *ast.Comment, *ast.CommentGroup:
+			return false
+		}
+		if node.Pos() > pos && f.fset.Position(node.Pos()).Line == line {
+			found = true
+		}
+		return true
+	})
+	return found
+}
+
+// A notest is a parsed notest comment, which may have a kind (begin or end),
+// an expiry date and a reason
+type notest struct {
+	kind   string    // "", "begin" or "end"
+	expiry time.Time // zero if there is no expiry date
+	reason string
+}
+
+// expired returns true if the expiry date has passed
+func (n notest) expired(now time.Time) bool {
+	return !n.expiry.IsZero() && !now.Before(n.expiry.AddDate(0, 0, 1))
+}
+
+// parseNotest parses a notest comment, which may use any of the provided
+// spellings of the directive in a // or /* */ comment. It returns false if the
+// comment is not a notest comment.
+func parseNotest(text string, spellings []string) (notest, bool, error) {
+	var n notest
+	var body string
+	switch {
+	case strings.HasPrefix(text, "//"):
+		body = strings.TrimPrefix(text[2:], " ")
+	case strings.HasPrefix(text, "/*"):
+		body = strings.TrimSpace(strings.TrimSuffix(text[2:], "*/"))
+	}
+	var suffix string
+	var found bool
+	for _, spelling := range spellings {
+		if strings.HasPrefix(body, spelling) {
+			suffix, found = strings.TrimPrefix(body, spelling), true
+			break
+		}
+	}
+	if !found {
+		return n, false, nil
+	}
+	for _, kind := range []string{"begin", "end"} {
+		rest := strings.TrimPrefix(suffix, ":"+kind)
+		if rest == suffix || (rest != "" && !strings.ContainsAny(rest[:1], " \t:(")) {
+			continue
+		}
+		// the reason for a begin or end must follow a colon, a date or a
+		// second comment, so prose such as "notest:begin markers must be
+		// balanced" isn't a directive
+		if trimmed := strings.TrimSpace(rest); trimmed != "" && rest[0] != ':' && rest[0] != '(' && !strings.HasPrefix(trimmed, "//") {
+			return n, false, nil
+		}
+		n.kind = kind
+		suffix = rest
+		break
+	}
+	// text in brackets that isn't an expiry date is kept as part of the
+	// reason e.g. notest(legacy reasons), but is reported as an error so the
+	// audit can fail
+	var err error
+	if strings.HasPrefix(suffix, "(") {
+		end := strings.Index(suffix, ")")
+		if end == -1 {
+			err = errors.New("expiry date has no closing bracket")
+		} else if expiry, perr := time.Parse("2006-01-02", suffix[1:end]); perr != nil {
+			err = errors.Errorf("invalid expiry date %q", suffix[1:end])
+		} else {
+			n.expiry = expiry
+			suffix = suffix[end+1:]
+		}
+	}
+	// the reason can follow a colon e.g. notest: reason, or a second comment
+	// e.g. notest // reason
+	suffix = strings.TrimPrefix(strings.TrimSpace(suffix), ":")
+	suffix = strings.TrimPrefix(strings.TrimSpace(suffix), "//")
+	n.reason = strings.TrimSpace(suffix)
+	return n, true, err
+}
+
+func (f *FileMap) inspectComment(cg *ast.CommentGroup) error {
 	for _, cm := range cg.List {
-		if !strings.HasPrefix(cm.Text, "//notest") && !strings.HasPrefix(cm.Text, "// notest") {
+		n, ok, err := parseNotest(cm.Text, f.directives)
+		if !ok {
+			continue
+		}
+
+		if f.setup.Audit {
+			if err != nil {
+				return errors.Wrapf(err, "%s", f.fset.Position(cm.Pos()))
+			}
+			if n.kind != "end" && n.reason == "" {
+				return errors.Errorf("%s: notest comment has no reason", f.fset.Position(cm.Pos()))
+			}
+			if n.expired(time.Now()) {
+				return errors.Errorf("%s: notest comment expired on %s", f.fset.Position(cm.Pos()), n.expiry.Format("2006-01-02"))
+			}
+		}
+
+		if n.kind != "" && !f.setup.Enabled(shared.RuleNotest) {
+			// unmatched ranges aren't an error when the rule is off
+			continue
+		}
+
+		// begin and end comments exclude the range of lines between them
+		switch n.kind {
+		case "begin":
+			if f.begin != nil {
+				return errors.Errorf("%s: notest:begin without notest:end", f.fset.Position(f.begin.Pos()))
+			}
+			f.begin = cm
+			continue
+		case "end":
+			if f.begin == nil {
+				return errors.Errorf("%s: notest:end without notest:begin", f.fset.Position(cm.Pos()))
+			}
+			f.excludeRange(shared.RuleNotest, f.begin.Pos(), cm.End())
+			f.begin = nil
+			continue
+		}
+
+		// a trailing comment only excludes the statement on the same line
+		if stmt, trailing := f.trailingStatement(cm); trailing {
+			if stmt == nil {
+				pos := f.fset.Position(cm.Pos())
+				f.addExclude(shared.RuleNotest, pos.Filename, pos.Line)
+				continue
+			}
+			start := f.fset.Position(stmt.Pos())
+			end := f.fset.Position(stmt.End()).Line
+			if block, ok := stmt.(*ast.BlockStmt); ok && f.codeAfter(block.Rbrace) {
+				// the closing line also starts other code e.g. "} else {"
+				end--
+			}
+			for line := start.Line; line <= end; line++ {
+				f.addExclude(shared.RuleNotest, start.Filename, line)
+			}
 			continue
 		}
 
@@ -202,10 +536,139 @@ func (f *FileMap) inspectComment(cg *ast.CommentGroup) {
 				endLine++
 			}
 			for line := comment.Line; line < endLine; line++ {
-				f.addExclude(start.Filename, line)
+				f.addExclude(shared.RuleNotest, start.Filename, line)
 			}
 		}
 	}
+	return nil
+}
+
+// ignoreDirective excludes a whole function when it appears in the function's
+// doc comment
+const ignoreDirective = "//courtney:ignore"
+
+// ignoreComment returns the ignore directive in a doc comment, if any, and the
+// reason that follows it e.g. //courtney:ignore only run in production
+func (f *FileMap) ignoreComment(doc *ast.CommentGroup) (cm *ast.Comment, reason string) {
+	if doc == nil {
+		return nil, ""
+	}
+	for _, cm := range doc.List {
+		if cm.Text == ignoreDirective || strings.HasPrefix(cm.Text, ignoreDirective+" ") {
+			reason = strings.TrimSpace(strings.TrimPrefix(cm.Text, ignoreDirective))
+			reason = strings.TrimSpace(strings.TrimPrefix(reason, "//"))
+			return cm, reason
+		}
+	}
+	return nil, ""
+}
+
+// functionRoles returns the rules that exclude a whole function because of
+// its role: func main() in package main, func init(), or a function with a
+// "Deprecated:" paragraph in its doc comment
+func (f *FileMap) functionRoles(decl *ast.FuncDecl) []shared.Rule {
+	var roles []shared.Rule
+	if decl.Recv == nil && decl.Type.TypeParams == nil {
+		switch decl.Name.Name {
+		case "main":
+			if f.file.Name.Name == "main" {
+				roles = append(roles, shared.RuleMain)
+			}
+		case "init":
+			roles = append(roles, shared.RuleInit)
+		}
+	}
+	if decl.Doc != nil {
+		for _, paragraph := range strings.Split(decl.Doc.Text(), "\n\n") {
+			if strings.HasPrefix(paragraph, "Deprecated: ") {
+				roles = append(roles, shared.RuleDeprecated)
+				break
+			}
+		}
+	}
+	return roles
+}
+
+// trivialInterfaces lists the interfaces that are satisfied by trivial single
+// statement methods: fmt.Stringer, error and encoding.TextMarshaler
+var trivialInterfaces = []*types.Interface{
+	types.NewInterfaceType([]*types.Func{
+		types.NewFunc(token.NoPos, nil, "String", types.NewSignatureType(nil, nil, nil, nil,
+			types.NewTuple(types.NewVar(token.NoPos, nil, "", types.Typ[types.String])), false)),
+	}, nil).Complete(),
+	errorType,
+	types.NewInterfaceType([]*types.Func{
+		types.NewFunc(token.NoPos, nil, "MarshalText", types.NewSignatureType(nil, nil, nil, nil,
+			types.NewTuple(
+				types.NewVar(token.NoPos, nil, "text", types.NewSlice(types.Typ[types.Byte])),
+				types.NewVar(token.NoPos, nil, "err", types.Universe.Lookup("error").Type()),
+			), false)),
+	}, nil).Complete(),
+}
+
+// isTrivial returns true if the function body is a single return of a field,
+// a constant or a fmt.Sprintf call, or if the function is a single statement
+// method that satisfies one of the trivialInterfaces
+func (f *FileMap) isTrivial(decl *ast.FuncDecl) bool {
+	if len(decl.Body.List) != 1 {
+		return false
+	}
+	if ret, ok := decl.Body.List[0].(*ast.ReturnStmt); ok && len(ret.Results) == 1 {
+		result := ast.Unparen(ret.Results[0])
+		if tv, ok := f.pkg.TypesInfo.Types[result]; ok && tv.Value != nil {
+			return true
+		}
+		switch result := result.(type) {
+		case *ast.SelectorExpr:
+			if sel, ok := f.pkg.TypesInfo.Selections[result]; ok && sel.Kind() == types.FieldVal {
+				return true
+			}
+		case *ast.CallExpr:
+			if fn, ok := typeutil.Callee(f.pkg.TypesInfo, result).(*types.Func); ok && fn.FullName() == "fmt.Sprintf" {
+				return true
+			}
+		}
+	}
+	fn, ok := f.pkg.TypesInfo.Defs[decl.Name].(*types.Func)
+	if !ok {
+		return false
+	}
+	sig := fn.Type().(*types.Signature)
+	if sig.Recv() == nil {
+		return false
+	}
+	for _, iface := range trivialInterfaces {
+		method := iface.Method(0)
+		if method.Name() == fn.Name() && types.Identical(method.Type(), sig) && types.Implements(sig.Recv().Type(), iface) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *PackageMap) excludeRange(rule shared.Rule, from, to token.Pos) {
+	start := p.fset.Position(from)
+	end := p.fset.Position(to)
+	for line := start.Line; line <= end.Line; line++ {
+		p.addExclude(rule, start.Filename, line)
+	}
+}
+
+// excludeElse excludes the statements of an else branch. The line the branch
+// starts on e.g. "} else {" is left out, since it is shared with the end of
+// the preceding body. The header of an else if is also left out.
+func (p *PackageMap) excludeElse(rule shared.Rule, stmt ast.Stmt) {
+	switch s := stmt.(type) {
+	case *ast.BlockStmt:
+		if len(s.List) > 0 {
+			p.excludeRange(rule, s.List[0].Pos(), s.List[len(s.List)-1].End())
+		}
+	case *ast.IfStmt:
+		p.excludeElse(rule, s.Body)
+		if s.Else != nil {
+			p.excludeElse(rule, s.Else)
+		}
+	}
 }
 
 func (f *FileMap) inspectNode(node ast.Node) (bool, error) {
@@ -213,19 +676,47 @@ func (f *FileMap) inspectNode(node ast.Node) (bool, error) {
 		return true, nil
 	}
 	switch n := node.(type) {
+	case *ast.FuncDecl:
+		if cm, reason := f.ignoreComment(n.Doc); cm != nil && n.Body != nil {
+			if f.setup.Audit && reason == "" {
+				return false, errors.Errorf("%s: courtney:ignore directive has no reason", f.fset.Position(cm.Pos()))
+			}
+			f.excludeRange(shared.RuleNotest, n.Body.Lbrace, n.Body.Rbrace)
+		}
+		if n.Body != nil {
+			for _, rule := range f.functionRoles(n) {
+				f.excludeRange(rule, n.Body.Lbrace, n.Body.Rbrace)
+			}
+			if f.isTrivial(n) {
+				f.excludeRange(shared.RuleTrivial, n.Body.Lbrace, n.Body.Rbrace)
+			}
+		}
 	case *ast.CallExpr:
-		if id, ok := n.Fun.(*ast.Ident); ok && id.Name == "panic" {
-			pos := f.fset.Position(n.Pos())
-			f.addExclude(pos.Filename, pos.Line)
+		switch callee := typeutil.Callee(f.pkg.TypesInfo, n).(type) {
+		case *types.Builtin:
+			if callee.Name() == "panic" {
+				pos := f.fset.Position(n.Pos())
+				f.addExclude(shared.RulePanic, pos.Filename, pos.Line)
+			}
+		case *types.Func:
+			// resolving the function via the type info ensures a local
+			// variable named e.g. log or os can't give a false match
+			if f.terminators[callee.FullName()] {
+				pos := f.fset.Position(n.Pos())
+				f.addExclude(shared.RuleExit, pos.Filename, pos.Line)
+			}
 		}
 	case *ast.IfStmt:
+		f.inspectConstant(n)
 		if err := f.inspectIf(n); err != nil {
 			return false, err
 		}
 	case *ast.SwitchStmt:
-		if n.Tag != nil {
+		f.inspectExhaustive(n)
+		if n.Tag != nil && !f.isError(n.Tag) {
 			// we are only concerned with switch statements with no tag
-			// expression e.g. switch { ... }
+			// expression e.g. switch { ... }, or with an error tag expression
+			// e.g. switch err { ... }
 			return true, nil
 		}
 		var falseExpr []ast.Expr
@@ -237,29 +728,425 @@ func (f *FileMap) inspectNode(node ast.Node) (bool, error) {
 				defaultClause = cc
 				continue
 			}
-			if err := f.inspectCase(cc, falseExpr...); err != nil {
+			list := f.caseExpressions(n.Tag, cc.List)
+			if err := f.inspectCase(cc, list, falseExpr...); err != nil {
 				return false, err
 			}
-			falseExpr = append(falseExpr, f.boolOr(cc.List))
+			falseExpr = append(falseExpr, f.boolOr(list))
 		}
 		if defaultClause != nil {
-			if err := f.inspectCase(defaultClause, falseExpr...); err != nil {
+			if err := f.inspectCase(defaultClause, nil, falseExpr...); err != nil {
 				return false, err
 			}
 		}
+	case *ast.TypeSwitchStmt:
+		f.inspectTypeSwitch(n)
+	case *ast.SelectStmt:
+		for _, s := range n.Body.List {
+			f.inspectCancel(s.(*ast.CommClause))
+		}
+	case *ast.DeferStmt:
+		if lit, ok := n.Call.Fun.(*ast.FuncLit); ok {
+			f.inspectRecover(lit)
+		}
 	}
 	return true, nil
 }
 
-func (f *FileMap) inspectCase(stmt *ast.CaseClause, falseExpr ...ast.Expr) error {
-	s := brenda.NewSolver(f.fset, f.pkg.TypesInfo.Uses, f.pkg.TypesInfo.Defs, f.boolOr(stmt.List), falseExpr...)
+// inspectRecover excludes the body of if statements in a deferred function
+// literal that are guarded by a non-nil recover() result e.g.
+// defer func() { if r := recover(); r != nil { ... } }()
+func (f *FileMap) inspectRecover(lit *ast.FuncLit) {
+	isRecover := func(e ast.Expr) bool {
+		c, ok := e.(*ast.CallExpr)
+		if !ok {
+			return false
+		}
+		b, ok := typeutil.Callee(f.pkg.TypesInfo, c).(*types.Builtin)
+		return ok && b.Name() == "recover"
+	}
+
+	// find the variables assigned the result of recover()
+	recovered := map[types.Object]bool{}
+	ast.Inspect(lit.Body, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.FuncLit:
+			// recover only works when called directly by the deferred function
+			return false
+		case *ast.AssignStmt:
+			if len(n.Lhs) == 1 && len(n.Rhs) == 1 && isRecover(n.Rhs[0]) {
+				if id, ok := n.Lhs[0].(*ast.Ident); ok {
+					recovered[f.pkg.TypesInfo.ObjectOf(id)] = true
+				}
+			}
+		case *ast.ValueSpec:
+			if len(n.Names) == 1 && len(n.Values) == 1 && isRecover(n.Values[0]) {
+				recovered[f.pkg.TypesInfo.ObjectOf(n.Names[0])] = true
+			}
+		}
+		return true
+	})
+	isRecovered := func(e ast.Expr) bool {
+		if isRecover(e) {
+			return true
+		}
+		id, ok := e.(*ast.Ident)
+		return ok && recovered[f.pkg.TypesInfo.ObjectOf(id)]
+	}
+
+	ast.Inspect(lit.Body, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.IfStmt:
+			b, ok := n.Cond.(*ast.BinaryExpr)
+			if !ok || b.Op != token.NEQ || len(n.Body.List) == 0 {
+				return true
+			}
+			if isRecovered(b.X) && f.isNil(b.Y) || isRecovered(b.Y) && f.isNil(b.X) {
+				f.excludeRange(shared.RuleRecover, n.Body.List[0].Pos(), n.Body.List[len(n.Body.List)-1].End())
+			}
+		}
+		return true
+	})
+}
+
+// inspectCancel handles a select case receiving from ctx.Done(), excluding code
+// in the case that returns ctx.Err() or a wrap of it
+func (f *FileMap) inspectCancel(cc *ast.CommClause) {
+	es, ok := cc.Comm.(*ast.ExprStmt)
+	if !ok {
+		return
+	}
+	recv, ok := es.X.(*ast.UnaryExpr)
+	if !ok || recv.Op != token.ARROW {
+		return
+	}
+	done := f.contextCall(recv.X, "Done")
+	if done == nil {
+		return
+	}
+	// find a call to ctx.Err() in the case body, to use as the search
+	// expression
+	var search ast.Expr
+	for _, stmt := range cc.Body {
+		ast.Inspect(stmt, func(node ast.Node) bool {
+			if search != nil {
+				return false
+			}
+			if e, ok := node.(ast.Expr); ok {
+				if c := f.contextCall(e, "Err"); c != nil && f.matcher.Match(c.X, done.X) {
+					search = e
+				}
+			}
+			return true
+		})
+	}
+	if search == nil {
+		return
+	}
+	f.processError(shared.RuleCancel, &ast.BlockStmt{Lbrace: cc.Pos(), List: cc.Body}, search)
+}
+
+// contextCall returns the selector of a call to the named context.Context
+// method e.g. ctx.Done(), or nil if the expression is not a call to that method
+func (f *FileMap) contextCall(e ast.Expr, method string) *ast.SelectorExpr {
+	c, ok := e.(*ast.CallExpr)
+	if !ok {
+		return nil
+	}
+	sel, ok := c.Fun.(*ast.SelectorExpr)
+	if !ok {
+		return nil
+	}
+	fn, ok := typeutil.Callee(f.pkg.TypesInfo, c).(*types.Func)
+	if !ok || fn.FullName() != "(context.Context)."+method {
+		return nil
+	}
+	return sel
+}
+
+// inspectConstant excludes the body of an if statement with a condition that
+// is always false, or the else branch when the condition is always true
+func (f *FileMap) inspectConstant(stmt *ast.IfStmt) {
+	value, known := f.constantCondition(stmt.Cond)
+	switch {
+	case !known:
+		return
+	case !value && len(stmt.Body.List) > 0:
+		body := stmt.Body.List
+		f.excludeRange(shared.RuleConstant, body[0].Pos(), body[len(body)-1].End())
+	case value && stmt.Else != nil:
+		f.excludeElse(shared.RuleConstant, stmt.Else)
+	}
+}
+
+// constantCondition evaluates a boolean expression that is known at compile
+// time. Comparisons of runtime.GOOS and runtime.GOARCH use the configured
+// platform rather than the platform the packages were loaded for.
+func (f *FileMap) constantCondition(e ast.Expr) (value, known bool) {
+	switch n := e.(type) {
+	case *ast.ParenExpr:
+		return f.constantCondition(n.X)
+	case *ast.UnaryExpr:
+		if n.Op == token.NOT {
+			value, known := f.constantCondition(n.X)
+			return !value, known
+		}
+	case *ast.BinaryExpr:
+		switch n.Op {
+		case token.LAND, token.LOR:
+			x, xKnown := f.constantCondition(n.X)
+			y, yKnown := f.constantCondition(n.Y)
+			if n.Op == token.LAND {
+				if xKnown && !x || yKnown && !y {
+					return false, true
+				}
+				return true, xKnown && yKnown
+			}
+			if xKnown && x || yKnown && y {
+				return true, true
+			}
+			return false, xKnown && yKnown
+		case token.EQL, token.NEQ:
+			if value, ok := f.platformValue(n.X, n.Y); ok {
+				return value == (n.Op == token.EQL), true
+			}
+			if value, ok := f.platformValue(n.Y, n.X); ok {
+				return value == (n.Op == token.EQL), true
+			}
+		}
+	}
+	if v := f.pkg.TypesInfo.Types[e].Value; v != nil && v.Kind() == constant.Bool {
+		if f.platformDependent(e, map[*types.Const]bool{}) {
+			return false, false
+		}
+		return constant.BoolVal(v), true
+	}
+	return false, false
+}
+
+// platformDependent returns true if the configured platform is not the one
+// the packages were loaded for, and the value of the expression might differ
+// between them e.g. const isWin = runtime.GOOS == "windows". The value of a
+// constant from another package can't be checked, so it's assumed to differ.
+func (f *FileMap) platformDependent(e ast.Expr, seen map[*types.Const]bool) bool {
+	if f.goos == f.hostGoos && f.goarch == f.hostGoarch {
+		return false
+	}
+	var dependent bool
+	ast.Inspect(e, func(node ast.Node) bool {
+		id, ok := node.(*ast.Ident)
+		if dependent || !ok {
+			return !dependent
+		}
+		c, ok := f.pkg.TypesInfo.Uses[id].(*types.Const)
+		if !ok || c.Pkg() == nil || seen[c] {
+			// not a constant, or a builtin such as true or iota
+			return true
+		}
+		seen[c] = true
+		if c.Pkg() != f.pkg.Types {
+			dependent = true
+			return false
+		}
+		file, value := f.constDecl(c)
+		if file == nil {
+			// notest
+			dependent = true
+			return false
+		}
+		// the constant may be declared differently for the configured
+		// platform e.g. in foo_windows.go
+		ctxt := build.Default
+		ctxt.GOOS, ctxt.GOARCH = f.goos, f.goarch
+		fpath := f.fset.File(file.Pos()).Name()
+		if match, err := ctxt.MatchFile(filepath.Dir(fpath), filepath.Base(fpath)); err != nil || !match {
+			dependent = true
+			return false
+		}
+		dependent = value != nil && f.platformDependent(value, seen)
+		return false
+	})
+	return dependent
+}
+
+// constDecl finds the file that declares a constant of the package, and the
+// expression that gives its value. The expression is repeated from an earlier
+// spec when it is omitted e.g. in a list of iota constants.
+func (f *FileMap) constDecl(c *types.Const) (*ast.File, ast.Expr) {
+	for _, file := range f.pkg.Syntax {
+		var value ast.Expr
+		var found bool
+		ast.Inspect(file, func(node ast.Node) bool {
+			gd, ok := node.(*ast.GenDecl)
+			if found || !ok || gd.Tok != token.CONST {
+				return !found
+			}
+			var values []ast.Expr
+			for _, spec := range gd.Specs {
+				vs := spec.(*ast.ValueSpec)
+				if len(vs.Values) > 0 {
+					values = vs.Values
+				}
+				for i, name := range vs.Names {
+					if f.pkg.TypesInfo.Defs[name] == c {
+						found = true
+						if i < len(values) {
+							value = values[i]
+						}
+					}
+				}
+			}
+			return false
+		})
+		if found {
+			return file, value
+		}
+	}
+	return nil, nil
+}
+
+// platformValue returns true if x is runtime.GOOS or runtime.GOARCH and y is
+// the string constant of the configured platform
+func (f *FileMap) platformValue(x, y ast.Expr) (equal, ok bool) {
+	sel, ok := x.(*ast.SelectorExpr)
+	if !ok {
+		return false, false
+	}
+	c, ok := f.pkg.TypesInfo.Uses[sel.Sel].(*types.Const)
+	if !ok || c.Pkg() == nil || c.Pkg().Path() != "runtime" {
+		return false, false
+	}
+	v := f.pkg.TypesInfo.Types[y].Value
+	if v == nil || v.Kind() != constant.String {
+		return false, false
+	}
+	switch c.Name() {
+	case "GOOS":
+		return constant.StringVal(v) == f.goos, true
+	case "GOARCH":
+		return constant.StringVal(v) == f.goarch, true
+	}
+	return false, false
+}
+
+// inspectExhaustive excludes the default clause of a switch on a value of a
+// named type, when every package level constant of that type is handled by
+// another case
+func (f *FileMap) inspectExhaustive(stmt *ast.SwitchStmt) {
+	if stmt.Tag == nil {
+		return
+	}
+	named, ok := types.Unalias(f.pkg.TypesInfo.TypeOf(stmt.Tag)).(*types.Named)
+	if !ok || named.Obj().Pkg() == nil {
+		return
+	}
+	var defaultClause *ast.CaseClause
+	var handled []constant.Value
+	for _, s := range stmt.Body.List {
+		cc := s.(*ast.CaseClause)
+		if cc.List == nil {
+			defaultClause = cc
+			continue
+		}
+		for _, e := range cc.List {
+			if v := f.pkg.TypesInfo.Types[e].Value; v != nil {
+				handled = append(handled, v)
+			}
+		}
+	}
+	if defaultClause == nil || len(defaultClause.Body) == 0 {
+		return
+	}
+	scope := named.Obj().Pkg().Scope()
+	var found bool
+	for _, name := range scope.Names() {
+		c, ok := scope.Lookup(name).(*types.Const)
+		if !ok || !types.Identical(c.Type(), named) {
+			continue
+		}
+		found = true
+		var covered bool
+		for _, v := range handled {
+			if constant.Compare(c.Val(), token.EQL, v) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			return
+		}
+	}
+	if !found {
+		return
+	}
+	body := defaultClause.Body
+	f.excludeRange(shared.RuleExhaustive, body[0].Pos(), body[len(body)-1].End())
+}
+
+// caseExpressions converts the expressions in a case clause of a switch with
+// a tag expression to comparisons e.g. switch err { case nil: ... } has the
+// case expression err == nil.
+func (f *FileMap) caseExpressions(tag ast.Expr, list []ast.Expr) []ast.Expr {
+	if tag == nil {
+		return list
+	}
+	var out []ast.Expr
+	for _, e := range list {
+		out = append(out, &ast.BinaryExpr{X: tag, Op: token.EQL, Y: e})
+	}
+	return out
+}
+
+func (f *FileMap) inspectCase(stmt *ast.CaseClause, list []ast.Expr, falseExpr ...ast.Expr) error {
+	s := brenda.NewSolver(f.fset, f.pkg.TypesInfo.Uses, f.pkg.TypesInfo.Defs, f.boolOr(list), falseExpr...)
 	if err := s.SolveTrue(); err != nil {
 		return errors.WithStack(err)
 	}
-	f.processResults(s, &ast.BlockStmt{List: stmt.Body})
+	f.processResults(s, &ast.BlockStmt{Lbrace: stmt.Pos(), List: stmt.Body})
 	return nil
 }
 
+// inspectTypeSwitch handles type switches on an error e.g.
+// switch e := err.(type) { ... }. The error is non-nil in any case clause that
+// doesn't include nil, and in the default clause if another case includes nil.
+func (f *FileMap) inspectTypeSwitch(stmt *ast.TypeSwitchStmt) {
+	var assert ast.Expr
+	switch a := stmt.Assign.(type) {
+	case *ast.ExprStmt:
+		assert = a.X
+	case *ast.AssignStmt:
+		assert = a.Rhs[0]
+	}
+	ta, ok := assert.(*ast.TypeAssertExpr)
+	if !ok || !f.isError(ta.X) {
+		return
+	}
+	var nilCase bool
+	var defaultClause *ast.CaseClause
+	for _, s := range stmt.Body.List {
+		cc := s.(*ast.CaseClause)
+		if cc.List == nil {
+			defaultClause = cc
+			continue
+		}
+		nonNil := true
+		for _, e := range cc.List {
+			if f.isNil(e) {
+				nonNil = false
+				nilCase = true
+			}
+		}
+		if nonNil {
+			f.processError(shared.RuleError, &ast.BlockStmt{Lbrace: cc.Pos(), List: cc.Body}, ta.X)
+		}
+	}
+	if defaultClause != nil && nilCase {
+		f.processError(shared.RuleError, &ast.BlockStmt{Lbrace: defaultClause.Pos(), List: defaultClause.Body}, ta.X)
+	}
+}
+
 func (f *FileMap) boolOr(list []ast.Expr) ast.Expr {
 	if len(list) == 0 {
 		return nil
@@ -315,13 +1202,357 @@ func (f *FileMap) processResults(s *brenda.Solver, block *ast.BlockStmt) {
 			continue
 		}
 		if op == token.NEQ && match.Match || op == token.EQL && match.Inverse {
-			ast.Inspect(block, f.inspectNodeForReturn(expr))
-			ast.Inspect(block, f.inspectNodeForWrap(block, expr))
+			f.processError(shared.RuleError, block, expr)
 		}
 	}
 }
 
+// processError excludes code in the block that returns expr, which is an error
+// known to be non-nil
+func (f *FileMap) processError(rule shared.Rule, block *ast.BlockStmt, expr ast.Expr) {
+	if rule == shared.RuleError && f.setup.Strict && !f.isExternalError(block, expr) {
+		return
+	}
+	ast.Inspect(block, f.inspectNodeForReturn(rule, expr))
+	ast.Inspect(block, f.inspectNodeForWrap(rule, block, expr))
+	ast.Inspect(block, f.inspectNodeForSink(rule, expr))
+}
+
+// isExternalError returns true if the error was returned by a call into
+// another module or the standard library
+func (f *FileMap) isExternalError(block *ast.BlockStmt, expr ast.Expr) bool {
+	return f.isExternalValue(expr, block.Pos(), map[ast.Expr]bool{})
+}
+
+// isExternalValue returns true if the error used at pos was returned by a call
+// into another module or the standard library. A variable is external if every
+// assignment that can reach pos is, and a call that wraps an error e.g.
+// fmt.Errorf("...: %w", err) is external if the error it wraps is.
+func (f *FileMap) isExternalValue(expr ast.Expr, pos token.Pos, visiting map[ast.Expr]bool) bool {
+	if visiting[expr] {
+		return false
+	}
+	visiting[expr] = true
+	defer delete(visiting, expr)
+
+	switch e := ast.Unparen(expr).(type) {
+	case *ast.Ident:
+		var external bool
+		for _, a := range f.reachingAssignments(e, pos) {
+			if a.zero {
+				// a zero value can't be the non-nil error
+				continue
+			}
+			if a.value == nil || !f.isExternalValue(a.value, a.value.Pos(), visiting) {
+				return false
+			}
+			external = true
+		}
+		return external
+	case *ast.CallExpr:
+		var wrapped bool
+		for _, arg := range e.Args {
+			if !f.isError(arg) {
+				continue
+			}
+			if f.isExternalValue(arg, e.Pos(), visiting) {
+				return true
+			}
+			wrapped = true
+		}
+		if wrapped {
+			return false
+		}
+		fn, ok := typeutil.Callee(f.pkg.TypesInfo, e).(*types.Func)
+		return ok && f.isExternal(fn.Pkg())
+	}
+	return false
+}
+
+// assignment is an assignment to a local variable. value is nil if the value
+// is unknown e.g. a parameter, and zero is true for a declaration without a
+// value e.g. var err error.
+type assignment struct {
+	stmt  ast.Node // the statement, or the function for a parameter
+	list  ast.Node // the node containing stmt e.g. a block or if statement
+	value ast.Expr
+	zero  bool
+}
+
+// reachingAssignments returns the assignments to a local variable that can
+// reach pos in the function that declares it. This isn't a full data flow
+// analysis: an assignment in the same statement list as pos, or a list that
+// contains it, always runs before pos and hides the assignments before it.
+// Assignments after pos are only included if they're in a loop containing pos.
+func (f *FileMap) reachingAssignments(id *ast.Ident, pos token.Pos) []assignment {
+	obj := f.pkg.TypesInfo.ObjectOf(id)
+	if obj == nil {
+		return nil
+	}
+	contains := func(n ast.Node, pos token.Pos) bool {
+		return n.Pos() <= pos && pos < n.End()
+	}
+
+	// find the innermost function that declares the variable
+	var fn ast.Node
+	var ftype *ast.FuncType
+	ast.Inspect(f.file, func(node ast.Node) bool {
+		if node == nil || !contains(node, obj.Pos()) {
+			return false
+		}
+		switch n := node.(type) {
+		case *ast.FuncDecl:
+			fn, ftype = n, n.Type
+		case *ast.FuncLit:
+			fn, ftype = n, n.Type
+		}
+		return true
+	})
+	if fn == nil || !contains(fn, pos) {
+		return nil
+	}
+
+	var all []assignment
+	if ftype.Params != nil {
+		for _, field := range ftype.Params.List {
+			for _, name := range field.Names {
+				if f.pkg.TypesInfo.Defs[name] == obj {
+					all = append(all, assignment{stmt: fn})
+				}
+			}
+		}
+	}
+	var loops []ast.Node
+	var stack []ast.Node
+	add := func(stmt ast.Node, lhs []*ast.Ident, rhs []ast.Expr, define bool) {
+		for i, name := range lhs {
+			if name == nil || f.pkg.TypesInfo.ObjectOf(name) != obj {
+				continue
+			}
+			a := assignment{stmt: stmt}
+			switch {
+			case len(rhs) == 0:
+				a.zero = define
+			case len(lhs) == len(rhs):
+				a.value = rhs[i]
+			case len(rhs) == 1:
+				a.value = rhs[0]
+			}
+			for j := len(stack) - 1; j >= 0; j-- {
+				if stack[j] == stmt && j > 0 {
+					a.list = stack[j-1]
+					break
+				}
+			}
+			all = append(all, a)
+		}
+	}
+	ast.Inspect(fn, func(node ast.Node) bool {
+		if node == nil {
+			stack = stack[:len(stack)-1]
+			return true
+		}
+		stack = append(stack, node)
+		switch n := node.(type) {
+		case *ast.ForStmt, *ast.RangeStmt:
+			if contains(n, pos) {
+				loops = append(loops, n)
+			}
+		case *ast.AssignStmt:
+			var lhs []*ast.Ident
+			for _, e := range n.Lhs {
+				name, _ := ast.Unparen(e).(*ast.Ident)
+				lhs = append(lhs, name)
+			}
+			add(n, lhs, n.Rhs, false)
+		case *ast.ValueSpec:
+			// the statement is the DeclStmt containing the GenDecl
+			if len(stack) >= 3 {
+				add(stack[len(stack)-3], n.Names, n.Values, true)
+			}
+		}
+		return true
+	})
+
+	// the last assignment that always runs before pos hides the ones before it
+	var last *assignment
+	for i, a := range all {
+		if a.stmt == fn || a.list == nil {
+			continue
+		}
+		if loop, ok := a.list.(*ast.ForStmt); ok && loop.Post == a.stmt {
+			// the post statement runs after the body
+			continue
+		}
+		if a.stmt.End() <= pos && contains(a.list, pos) {
+			last = &all[i]
+		}
+	}
+	var reaching []assignment
+	for _, a := range all {
+		switch {
+		case last == nil && a.stmt == fn:
+			// parameter
+			reaching = append(reaching, a)
+		case a.stmt == fn:
+		case last != nil && a.stmt.End() <= last.stmt.Pos():
+			// hidden by the last assignment that always runs
+		case a.stmt.End() <= pos:
+			reaching = append(reaching, a)
+		default:
+			// after pos, so only reached through a loop that doesn't also
+			// contain the last assignment that always runs
+			for _, loop := range loops {
+				if contains(loop, a.stmt.Pos()) && (last == nil || !contains(loop, last.stmt.Pos())) {
+					reaching = append(reaching, a)
+					break
+				}
+			}
+		}
+	}
+	return reaching
+}
+
+// isExternal returns true if the package is in another module or the standard
+// library
+func (p *PackageMap) isExternal(pkg *types.Package) bool {
+	if pkg == nil {
+		return false
+	}
+	path := pkg.Path()
+	if p.pkg.Module == nil {
+		// without module information, only the package itself is internal
+		return path != p.pkg.PkgPath
+	}
+	return path != p.pkg.Module.Path && !strings.HasPrefix(path, p.pkg.Module.Path+"/")
+}
+
+// inspectNodeForSink excludes statement lists that end by sending the error to
+// one of the configured sinks, optionally followed by a bare return (or a
+// return of zero values), continue or break
+func (f *FileMap) inspectNodeForSink(rule shared.Rule, search ast.Expr) func(node ast.Node) bool {
+	return func(node ast.Node) bool {
+		var list []ast.Stmt
+		switch n := node.(type) {
+		case *ast.BlockStmt:
+			list = n.List
+		case *ast.CaseClause:
+			list = n.Body
+		case *ast.CommClause:
+			list = n.Body
+		default:
+			return true
+		}
+		if len(list) == 0 {
+			return true
+		}
+		last := list[len(list)-1]
+		sink := last
+		if f.isSinkExit(last) {
+			if len(list) < 2 {
+				return true
+			}
+			sink = list[len(list)-2]
+		}
+		if f.isErrorSink(sink, search) {
+			f.excludeRange(rule, sink.Pos(), last.End())
+		}
+		return true
+	}
+}
+
+// isSinkExit returns true if the statement can follow an error sink
+func (f *FileMap) isSinkExit(stmt ast.Stmt) bool {
+	switch s := stmt.(type) {
+	case *ast.BranchStmt:
+		return s.Tok == token.CONTINUE || s.Tok == token.BREAK
+	case *ast.ReturnStmt:
+		for _, r := range s.Results {
+			if !f.isZero(r) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// isErrorSink returns true if the statement sends search to a sink
+func (f *FileMap) isErrorSink(stmt ast.Stmt, search ast.Expr) bool {
+	switch s := stmt.(type) {
+	case *ast.ExprStmt:
+		// e.g. http.Error(w, err.Error(), 500)
+		call, ok := s.X.(*ast.CallExpr)
+		if !ok {
+			return false
+		}
+		fn, ok := typeutil.Callee(f.pkg.TypesInfo, call).(*types.Func)
+		if !ok || !f.sinks[fn.FullName()] {
+			return false
+		}
+		for _, arg := range call.Args {
+			if f.isSinkValue(arg, search) {
+				return true
+			}
+		}
+	case *ast.SendStmt:
+		// e.g. errCh <- err
+		return f.setup.Sinks.Channels && f.isSinkValue(s.Value, search)
+	case *ast.AssignStmt:
+		// e.g. errs = append(errs, err)
+		if !f.setup.Sinks.Append || len(s.Rhs) != 1 {
+			return false
+		}
+		call, ok := s.Rhs[0].(*ast.CallExpr)
+		if !ok {
+			return false
+		}
+		b, ok := typeutil.Callee(f.pkg.TypesInfo, call).(*types.Builtin)
+		if !ok || b.Name() != "append" {
+			return false
+		}
+		for _, arg := range call.Args[1:] {
+			if f.isSinkValue(arg, search) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isSinkValue returns true if the expression is search, a wrap of search, or
+// search.Error()
+func (f *FileMap) isSinkValue(e, search ast.Expr) bool {
+	if f.matcher.Match(e, search) || f.isErrorWrap(e, search) {
+		return true
+	}
+	call, ok := e.(*ast.CallExpr)
+	if !ok || len(call.Args) != 0 {
+		return false
+	}
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	return ok && sel.Sel.Name == "Error" && f.matcher.Match(sel.X, search)
+}
+
 func (f *FileMap) isErrorComparison(e ast.Expr) (found bool, sign token.Token, expr ast.Expr) {
+	if c, ok := e.(*ast.CallExpr); ok {
+		// errors.Is with a non-nil target and errors.As are only true when the
+		// error is non-nil, so they are treated like err != nil
+		fn, ok := typeutil.Callee(f.pkg.TypesInfo, c).(*types.Func)
+		if !ok || len(c.Args) != 2 || !f.isError(c.Args[0]) {
+			return
+		}
+		switch fn.FullName() {
+		case "errors.Is", "github.com/pkg/errors.Is":
+			if !f.isNonNilError(c.Args[1]) {
+				return
+			}
+		case "errors.As", "github.com/pkg/errors.As":
+		default:
+			return
+		}
+		return true, token.NEQ, c.Args[0]
+	}
 	if b, ok := e.(*ast.BinaryExpr); ok {
 		if b.Op != token.NEQ && b.Op != token.EQL {
 			return
@@ -341,7 +1572,114 @@ func (f *FileMap) isErrorComparison(e ast.Expr) (found bool, sign token.Token, e
 	return
 }
 
-func (f *FileMap) inspectNodeForReturn(search ast.Expr) func(node ast.Node) bool {
+// sentinels lists the standard library error variables that are never nil, in
+// the form package path.name
+var sentinels = map[string]bool{
+	"bufio.ErrTooLong":           true,
+	"context.Canceled":           true,
+	"context.DeadlineExceeded":   true,
+	"database/sql.ErrConnDone":   true,
+	"database/sql.ErrNoRows":     true,
+	"database/sql.ErrTxDone":     true,
+	"errors.ErrUnsupported":      true,
+	"io.EOF":                     true,
+	"io.ErrClosedPipe":           true,
+	"io.ErrNoProgress":           true,
+	"io.ErrShortBuffer":          true,
+	"io.ErrShortWrite":           true,
+	"io.ErrUnexpectedEOF":        true,
+	"io/fs.ErrClosed":            true,
+	"io/fs.ErrExist":             true,
+	"io/fs.ErrInvalid":           true,
+	"io/fs.ErrNotExist":          true,
+	"io/fs.ErrPermission":        true,
+	"net.ErrClosed":              true,
+	"net/http.ErrAbortHandler":   true,
+	"net/http.ErrHandlerTimeout": true,
+	"net/http.ErrNoCookie":       true,
+	"net/http.ErrServerClosed":   true,
+	"os.ErrClosed":               true,
+	"os.ErrDeadlineExceeded":     true,
+	"os.ErrExist":                true,
+	"os.ErrInvalid":              true,
+	"os.ErrNoDeadline":           true,
+	"os.ErrNotExist":             true,
+	"os.ErrPermission":           true,
+	"os.ErrProcessDone":          true,
+	"os/exec.ErrNotFound":        true,
+	"strconv.ErrRange":           true,
+	"strconv.ErrSyntax":          true,
+}
+
+// isNonNilError returns true if the expression is provably a non-nil error: a
+// value of a concrete type, a call to errors.New or fmt.Errorf, one of the
+// standard library sentinels, or a package level variable that is initialised
+// with one of these and never assigned.
+func (f *FileMap) isNonNilError(e ast.Expr) bool {
+	e = ast.Unparen(e)
+	t := f.pkg.TypesInfo.TypeOf(e)
+	if t == nil || f.isNil(e) {
+		return false
+	}
+	if !types.IsInterface(t) {
+		// converting a concrete value to an interface never gives nil
+		return true
+	}
+	var obj types.Object
+	switch e := e.(type) {
+	case *ast.CallExpr:
+		fn, ok := typeutil.Callee(f.pkg.TypesInfo, e).(*types.Func)
+		if !ok {
+			return false
+		}
+		switch fn.FullName() {
+		case "errors.New", "fmt.Errorf", "github.com/pkg/errors.New", "github.com/pkg/errors.Errorf":
+			return true
+		}
+		return false
+	case *ast.Ident:
+		obj = f.pkg.TypesInfo.Uses[e]
+	case *ast.SelectorExpr:
+		obj = f.pkg.TypesInfo.Uses[e.Sel]
+	}
+	v, ok := obj.(*types.Var)
+	if !ok || v.Pkg() == nil || v.Pkg().Scope().Lookup(v.Name()) != v {
+		return false
+	}
+	if v.Pkg() != f.pkg.Types {
+		return sentinels[v.Pkg().Path()+"."+v.Name()]
+	}
+
+	// find the initial value, and anything that could change it
+	var value ast.Expr
+	var assigned bool
+	for _, file := range f.pkg.Syntax {
+		ast.Inspect(file, func(node ast.Node) bool {
+			switch n := node.(type) {
+			case *ast.ValueSpec:
+				for i, name := range n.Names {
+					if f.pkg.TypesInfo.Defs[name] == v && len(n.Values) == len(n.Names) {
+						value = n.Values[i]
+					}
+				}
+			case *ast.AssignStmt:
+				for _, lhs := range n.Lhs {
+					if id, ok := ast.Unparen(lhs).(*ast.Ident); ok && f.pkg.TypesInfo.Uses[id] == v {
+						assigned = true
+					}
+				}
+			case *ast.UnaryExpr:
+				if id, ok := ast.Unparen(n.X).(*ast.Ident); ok && n.Op == token.AND && f.pkg.TypesInfo.Uses[id] == v {
+					assigned = true
+				}
+			}
+			return true
+		})
+	}
+	return value != nil && !assigned && f.isNonNilError(value)
+}
+
+func (f *FileMap) inspectNodeForReturn(rule shared.Rule, search ast.Expr) func(node ast.Node) bool {
 	return func(node ast.Node) bool {
 		if node == nil {
 			return true
@@ -350,14 +1688,68 @@ func (f *FileMap) inspectNodeForReturn(search ast.Expr) func(node ast.Node) bool
 		case *ast.ReturnStmt:
 			if f.isErrorReturn(n, search) {
 				pos := f.fset.Position(n.Pos())
-				f.addExclude(pos.Filename, pos.Line)
+				f.addExclude(rule, pos.Filename, pos.Line)
+			}
+		case *ast.AssignStmt:
+			if f.isErrorResultAssign(n, search) {
+				pos := f.fset.Position(n.Pos())
+				f.addExclude(rule, pos.Filename, pos.Line)
 			}
 		}
 		return true
 	}
 }
 
-func (f *FileMap) inspectNodeForWrap(block *ast.BlockStmt, search ast.Expr) func(node ast.Node) bool {
+func (f *FileMap) isErrorResultAssign(a *ast.AssignStmt, search ast.Expr) bool {
+	// covers the syntax:
+	// func a() (err error) {
+	// 	defer func() {
+	// 		if cerr := f.Close(); cerr != nil && err == nil {
+	// 			err = cerr
+	// 		}
+	// 	}()
+	// }
+	if a.Tok != token.ASSIGN || len(a.Lhs) != 1 || len(a.Rhs) != 1 {
+		return false
+	}
+	id, ok := a.Lhs[0].(*ast.Ident)
+	if !ok {
+		return false
+	}
+	obj := f.pkg.TypesInfo.Uses[id]
+	if obj == nil || !f.isError(id) {
+		return false
+	}
+	if !f.matcher.Match(a.Rhs[0], search) && !f.isErrorWrap(a.Rhs[0], search) {
+		return false
+	}
+	// check the identifier is the last named result of a function that
+	// encloses the assignment
+	var found bool
+	ast.Inspect(f.file, func(node ast.Node) bool {
+		if found || node == nil || a.Pos() < node.Pos() || a.End() > node.End() {
+			return false
+		}
+		var t *ast.FuncType
+		switch n := node.(type) {
+		case *ast.FuncDecl:
+			t = n.Type
+		case *ast.FuncLit:
+			t = n.Type
+		}
+		if t == nil || t.Results == nil || len(t.Results.List) == 0 {
+			return true
+		}
+		last := t.Results.List[len(t.Results.List)-1]
+		if len(last.Names) > 0 && f.pkg.TypesInfo.Defs[last.Names[len(last.Names)-1]] == obj {
+			found = true
+		}
+		return true
+	})
+	return found
+}
+
+func (f *FileMap) inspectNodeForWrap(rule shared.Rule, block *ast.BlockStmt, search ast.Expr) func(node ast.Node) bool {
 	return func(node ast.Node) bool {
 		if node == nil {
 			return true
@@ -392,8 +1784,8 @@ func (f *FileMap) inspectNodeForWrap(block *ast.BlockStmt, search ast.Expr) func
 			}
 			newSearch := spec.Names[0]
 
-			if f.isErrorCall(spec.Values[0], search) {
-				ast.Inspect(block, f.inspectNodeForReturn(newSearch))
+			if f.isErrorWrap(spec.Values[0], search) {
+				ast.Inspect(block, f.inspectNodeForReturn(rule, newSearch))
 			}
 
 		case *ast.AssignStmt:
@@ -403,22 +1795,54 @@ func (f *FileMap) inspectNodeForWrap(block *ast.BlockStmt, search ast.Expr) func
 			}
 			newSearch := n.Lhs[0]
 
-			if f.isErrorCall(n.Rhs[0], search) {
-				ast.Inspect(block, f.inspectNodeForReturn(newSearch))
+			if f.isErrorWrap(n.Rhs[0], search) {
+				ast.Inspect(block, f.inspectNodeForReturn(rule, newSearch))
 			}
 		}
 		return true
 	}
 }
 
+// isErrorWrap returns true if expr is an error that wraps search: either the
+// result of a function taking search as a parameter e.g. errors.Wrap(err, ""),
+// or a composite literal containing search e.g. &QueryError{Err: err}.
+func (f *FileMap) isErrorWrap(expr, search ast.Expr) bool {
+	switch n := expr.(type) {
+	case *ast.CallExpr:
+		return f.isErrorCall(n, search)
+	case *ast.UnaryExpr:
+		if n.Op != token.AND {
+			return false
+		}
+		cl, ok := n.X.(*ast.CompositeLit)
+		return ok && f.isError(n) && f.isErrorLiteral(cl, search)
+	case *ast.CompositeLit:
+		return f.isError(n) && f.isErrorLiteral(n, search)
+	}
+	return false
+}
+
+// isErrorLiteral returns true if one of the elements of the composite literal
+// is search, or wraps search
+func (f *FileMap) isErrorLiteral(cl *ast.CompositeLit, search ast.Expr) bool {
+	for _, e := range cl.Elts {
+		if kve, ok := e.(*ast.KeyValueExpr); ok {
+			e = kve.Value
+		}
+		if f.matcher.Match(e, search) || f.isErrorWrap(e, search) {
+			return true
+		}
+	}
+	return false
+}
+
 func (f *FileMap) isErrorCall(expr, search ast.Expr) bool {
 	n, ok := expr.(*ast.CallExpr)
 	if !ok {
 		return false
 	}
 	if !f.isError(n) {
-		// never gets here, but leave it in for completeness
-		// notest
+		// e.g. a field of a composite literal: &QueryError{Query: q.String()}
 		return false
 	}
 	for _, arg := range n.Args {
@@ -487,15 +1911,21 @@ func (f *FileMap) isErrorReturn(r *ast.ReturnStmt, search ast.Expr) bool {
 		}
 	}
 
-	return f.matcher.Match(last, search) || f.isErrorCall(last, search)
+	return f.matcher.Match(last, search) || f.isErrorWrap(last, search)
 }
 
+// errorType is the predeclared error interface
+var errorType = types.Universe.Lookup("error").Type().Underlying().(*types.Interface)
+
+// isError returns true if the type of the expression implements the error
+// interface. This includes error itself, concrete error types such as
+// *MyError and named interfaces that embed error.
 func (f *FileMap) isError(v ast.Expr) bool {
-	if n, ok := f.pkg.TypesInfo.TypeOf(v).(*types.Named); ok {
-		o := n.Obj()
-		return o != nil && o.Pkg() == nil && o.Name() == "error"
+	t := f.pkg.TypesInfo.TypeOf(v)
+	if t == nil {
+		return false
 	}
-	return false
+	return types.Implements(t, errorType)
 }
 
 func (f *FileMap) isNil(v ast.Expr) bool {
@@ -503,6 +1933,10 @@ func (f *FileMap) isNil(v ast.Expr) bool {
 	return t.IsNil()
 }
 
+// isZero returns true if the expression is provably a zero value: nil, a zero
+// constant, a composite literal of zero values, *new(T), a conversion of a zero
+// value e.g. T(0), or a variable that is never assigned after a zero
+// declaration e.g. var zero T.
 func (f *FileMap) isZero(v ast.Expr) bool {
 	t := f.pkg.TypesInfo.Types[v]
 	if t.IsNil() {
@@ -522,17 +1956,157 @@ func (f *FileMap) isZero(v ast.Expr) bool {
 			return false
 		}
 	}
-	if t.IsValue() {
-		if cl, ok := v.(*ast.CompositeLit); ok {
-			for _, e := range cl.Elts {
-				if kve, ok := e.(*ast.KeyValueExpr); ok {
-					e = kve.Value
+	switch e := v.(type) {
+	case *ast.ParenExpr:
+		return f.isZero(e.X)
+	case *ast.CompositeLit:
+		for _, e := range e.Elts {
+			if kve, ok := e.(*ast.KeyValueExpr); ok {
+				e = kve.Value
+			}
+			if !f.isZero(e) {
+				return false
+			}
+		}
+		return true
+	case *ast.CallExpr:
+		// conversion e.g. T(0)
+		if len(e.Args) == 1 && f.pkg.TypesInfo.Types[e.Fun].IsType() {
+			return f.isZero(e.Args[0])
+		}
+	case *ast.Ident:
+		if zero, known := f.zeroVariable(e); known {
+			return zero
+		}
+	}
+	// values that can't be checked e.g. function results or parameters are
+	// assumed to be zero
+	return true
+}
+
+// zeroVariable checks a local variable that is never assigned to, sliced or
+// has its address taken after its declaration, in the function that declares
+// it. zero is true if it's declared with a zero value, and false if it's
+// declared with a non-zero value. known is false if the identifier is not
+// such a variable, or its initial value can't be checked, so the permissive
+// default applies.
+func (f *FileMap) zeroVariable(id *ast.Ident) (zero, known bool) {
+	obj, ok := f.pkg.TypesInfo.Uses[id].(*types.Var)
+	if !ok || obj.Parent() == nil || obj.Parent() == f.pkg.Types.Scope() {
+		return false, false
+	}
+
+	// find the declaration e.g. var zero T or zero := T{}. value is nil if
+	// the initial value can't be checked e.g. x, err := f()
+	var decl ast.Node
+	var value ast.Expr
+	ast.Inspect(f.file, func(node ast.Node) bool {
+		if decl != nil {
+			return false
+		}
+		switch n := node.(type) {
+		case *ast.ValueSpec:
+			for i, name := range n.Names {
+				if f.pkg.TypesInfo.Defs[name] == obj {
+					decl = n
+					zero = len(n.Values) == 0
+					if len(n.Values) == len(n.Names) {
+						value = n.Values[i]
+					}
+				}
+			}
+		case *ast.AssignStmt:
+			for i, lhs := range n.Lhs {
+				if id, ok := lhs.(*ast.Ident); ok && f.pkg.TypesInfo.Defs[id] == obj {
+					decl = n
+					if len(n.Lhs) == len(n.Rhs) {
+						value = n.Rhs[i]
+					}
 				}
-				if !f.isZero(e) {
-					return false
+			}
+		}
+		return true
+	})
+	if decl == nil || value == nil && !zero {
+		return false, false
+	}
+
+	scope := f.findScope(decl, func(n ast.Node) bool {
+		switch n.(type) {
+		case *ast.FuncDecl, *ast.FuncLit:
+			return true
+		}
+		return false
+	})
+	if scope == nil {
+		// notest
+		return false, false
+	}
+
+	// look for anything that could change the value
+	var assigned bool
+	written := func(e ast.Expr) {
+		for e != nil {
+			switch x := e.(type) {
+			case *ast.Ident:
+				if f.pkg.TypesInfo.Uses[x] == obj {
+					assigned = true
 				}
+				return
+			case *ast.ParenExpr:
+				e = x.X
+			case *ast.SelectorExpr:
+				e = x.X
+			case *ast.IndexExpr:
+				e = x.X
+			default:
+				return
 			}
 		}
 	}
-	return true
+	ast.Inspect(scope, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.AssignStmt:
+			for _, lhs := range n.Lhs {
+				written(lhs)
+			}
+		case *ast.IncDecStmt:
+			written(n.X)
+		case *ast.UnaryExpr:
+			if n.Op == token.AND {
+				written(n.X)
+			}
+		case *ast.SliceExpr:
+			// slicing an array aliases it, like taking the address
+			written(n.X)
+		case *ast.RangeStmt:
+			if n.Tok == token.ASSIGN {
+				written(n.Key)
+				written(n.Value)
+			}
+		case *ast.SelectorExpr:
+			// calling a method with a pointer receiver takes the address
+			sel := f.pkg.TypesInfo.Selections[n]
+			if sel == nil || sel.Kind() != types.MethodVal {
+				return true
+			}
+			recv := sel.Obj().Type().(*types.Signature).Recv()
+			if _, ok := recv.Type().(*types.Pointer); !ok {
+				return true
+			}
+			if _, ok := f.pkg.TypesInfo.TypeOf(n.X).Underlying().(*types.Pointer); !ok {
+				written(n.X)
+			}
+		}
+		return !assigned
+	})
+	if assigned {
+		// the value may have changed e.g. n, err = f()
+		return false, false
+	}
+	if value != nil {
+		// false if declared with a non-zero value e.g. x := 5
+		return f.isZero(value), true
+	}
+	return true, true
 }
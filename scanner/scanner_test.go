@@ -1,7 +1,11 @@
 package scanner_test
 
 import (
+	"go/ast"
+	"os"
+	"reflect"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
 	"testing"
@@ -13,6 +17,7 @@ import (
 	"github.com/dave/patsy"
 	"github.com/dave/patsy/builder"
 	"github.com/dave/patsy/vos"
+	"golang.org/x/tools/go/packages"
 )
 
 func TestSingle(t *testing.T) {
@@ -97,6 +102,334 @@ func TestSwitchCase(t *testing.T) {
 	test(t, tests)
 }
 
+func TestErrorSwitch(t *testing.T) {
+	tests := map[string]string{
+		"tag": `package a
+			
+			func a() error {
+				var err error
+				switch err {
+				case nil:
+					return err
+				default:
+					return err // *
+				}
+			}
+		`,
+		"tag with init": `package a
+			
+			import "fmt"
+			
+			func a() error {
+				switch _, err := fmt.Println(); err {
+				case nil:
+					return nil
+				default:
+					return err // *
+				}
+			}
+		`,
+		"tag sentinel": `package a
+			
+			import "io"
+			
+			func a() error {
+				var err error
+				switch err {
+				case io.EOF:
+					return err
+				case nil:
+					return nil
+				default:
+					return err // *
+				}
+			}
+		`,
+		"tag no nil case": `package a
+			
+			import "io"
+			
+			func a() error {
+				var err error
+				switch err {
+				case io.EOF:
+					return nil
+				default:
+					return err
+				}
+			}
+		`,
+		"type switch": `package a
+			
+			import "os"
+			
+			func a() error {
+				var err error
+				switch e := err.(type) {
+				case nil:
+					return nil
+				case *os.PathError:
+					return err // *
+				case interface{ Timeout() bool }, *os.LinkError:
+					_ = e
+					return err // *
+				default:
+					return err // *
+				}
+			}
+		`,
+		"type switch no nil case": `package a
+			
+			import "os"
+			
+			func a() error {
+				var err error
+				switch err.(type) {
+				case *os.PathError:
+					return err // *
+				default:
+					return err
+				}
+			}
+		`,
+		"type switch nil with type": `package a
+			
+			import "os"
+			
+			func a() error {
+				var err error
+				switch err.(type) {
+				case nil, *os.PathError:
+					return err
+				}
+				return nil
+			}
+		`,
+		"type switch not error": `package a
+			
+			import "os"
+			
+			func a() error {
+				var err error
+				var i interface{}
+				switch i.(type) {
+				case *os.PathError:
+					return err
+				}
+				return nil
+			}
+		`,
+	}
+	test(t, tests)
+}
+
+func TestConstant(t *testing.T) {
+	tests := map[string]string{
+		"constant": `package a
+			
+			import "fmt"
+			
+			const debug = false
+			const verbose = true
+			
+			func a(i int) {
+				if debug {
+					fmt.Println("debug") // *
+					fmt.Println("debug") // *
+				}
+				if debug && i > 1 {
+					fmt.Println("debug") // *
+				}
+				if !verbose {
+					fmt.Println("quiet") // *
+				} else {
+					fmt.Println("verbose")
+				}
+				if verbose || i > 1 {
+					fmt.Println("verbose")
+				} else {
+					fmt.Println("quiet") // *
+				}
+				if verbose {
+					fmt.Println("verbose")
+				} else if i > 1 {
+					fmt.Println("big") // *
+				} else {
+					fmt.Println("small") // *
+				}
+				if debug || i > 1 {
+					fmt.Println("debug")
+				}
+			}
+			`,
+		"platform": `package a
+			
+			import (
+				"fmt"
+				"runtime"
+			)
+			
+			func a() {
+				if runtime.GOOS == "windows" {
+					fmt.Println("windows") // *
+				} else if runtime.GOOS == "plan9" || runtime.GOARCH != "amd64" {
+					fmt.Println("plan9") // *
+				} else {
+					fmt.Println("linux")
+				}
+				if runtime.GOOS != "linux" {
+					fmt.Println("not linux") // *
+				}
+				if "linux" == runtime.GOOS && runtime.GOARCH == "amd64" {
+					fmt.Println("linux")
+				}
+			}
+			`,
+	}
+	testSetup(t, func(s *shared.Setup) {
+		s.Rules = map[shared.Rule]bool{shared.RuleConstant: true}
+		s.GOOS = "linux"
+		s.GOARCH = "amd64"
+	}, tests)
+
+	testSetup(t, func(s *shared.Setup) {
+		s.Rules = map[shared.Rule]bool{shared.RuleConstant: true}
+		s.GOOS = "windows"
+		s.GOARCH = "arm64"
+	}, map[string]string{
+		"other platform": `package a
+			
+			import (
+				"fmt"
+				"os"
+				"runtime"
+			)
+			
+			func a() {
+				if runtime.GOOS == "windows" {
+					fmt.Println("windows")
+				} else {
+					fmt.Println("other") // *
+				}
+				if runtime.GOARCH == "amd64" {
+					fmt.Println("amd64") // *
+				}
+				// constants that depend on the platform the packages were
+				// loaded for aren't known
+				if isWin {
+					fmt.Println("windows")
+				}
+				if !isWin {
+					fmt.Println("other")
+				}
+				if os.PathSeparator == '\\' {
+					fmt.Println("windows")
+				}
+				if debug {
+					fmt.Println("debug") // *
+				}
+			}
+			
+			const isWin = runtime.GOOS == "windows"
+			
+			const debug = false
+			`,
+	})
+}
+
+func TestExhaustive(t *testing.T) {
+	source := `package a
+			
+			import (
+				"fmt"
+				"time"
+			)
+			
+			type State int
+			
+			const (
+				A State = iota
+				B
+				C
+			)
+			
+			const D = 4
+			
+			func a(state State) error {
+				switch s := state; s {
+				case A:
+					return nil
+				case B, C:
+					return nil
+				default:
+					return fmt.Errorf("unknown %v", s) // *
+				}
+			}
+			
+			func b(state State) error {
+				switch state {
+				case A, B:
+					return nil
+				default:
+					return fmt.Errorf("unknown %v", state)
+				}
+			}
+			
+			func c(i int) error {
+				switch i {
+				case 1:
+					return nil
+				default:
+					return fmt.Errorf("unknown %v", i)
+				}
+			}
+			
+			func d(m time.Month) error {
+				switch m {
+				case time.January, time.February, time.March, time.April, time.May, time.June:
+					return nil
+				case time.July, time.August, time.September, time.October, time.November, time.December:
+					return nil
+				default:
+					return fmt.Errorf("unknown %v", m) // *
+				}
+			}
+			
+			type Level int
+			
+			const (
+				Low Level = iota
+				High
+				unknown
+			)
+			
+			const Default = Low
+			
+			type Alias = Level
+			
+			func e(l Level) error {
+				switch l {
+				case Low, High:
+					return nil
+				default:
+					return fmt.Errorf("unknown %v", l)
+				}
+			}
+			
+			func f(l Alias) error {
+				switch l {
+				case Default, High, unknown:
+					return nil
+				default:
+					return fmt.Errorf("unknown %v", l) // *
+				}
+			}
+			`
+	testSetup(t, func(s *shared.Setup) {
+		s.Rules = map[shared.Rule]bool{shared.RuleExhaustive: true}
+	}, map[string]string{"exhaustive": source})
+}
+
 func TestNamedParameters(t *testing.T) {
 	tests := map[string]string{
 		"named parameters simple": `package a
@@ -159,6 +492,200 @@ func TestNamedParameters(t *testing.T) {
 	test(t, tests)
 }
 
+func TestNamedResultAssign(t *testing.T) {
+	tests := map[string]string{
+		"deferred close": `package a
+			
+			import (
+				"fmt"
+				"os"
+			)
+			
+			func a() (err error) {
+				f, err := os.Open("")
+				if err != nil {
+					return err // *
+				}
+				defer func() {
+					if cerr := f.Close(); cerr != nil && err == nil {
+						err = cerr // *
+					}
+				}()
+				defer func() {
+					if cerr := f.Close(); cerr != nil {
+						err = fmt.Errorf("close: %w", cerr) // *
+					}
+				}()
+				return nil
+			}
+			`,
+		"multiple results": `package a
+			
+			import "os"
+			
+			func a() (i int, err error) {
+				var f *os.File
+				if cerr := f.Close(); cerr != nil {
+					err = cerr // *
+				}
+				return 0, err
+			}
+			`,
+		"not a result": `package a
+			
+			import "os"
+			
+			func a() (err error, other error) {
+				var f *os.File
+				var local error
+				if cerr := f.Close(); cerr != nil {
+					local = cerr
+					err = cerr
+				}
+				_ = local
+				return nil, nil
+			}
+			`,
+		"not tested": `package a
+			
+			import "os"
+			
+			func a() (err error) {
+				var f *os.File
+				if cerr := f.Close(); cerr == nil {
+					err = cerr
+				}
+				return nil
+			}
+			`,
+		"empty results": `package a
+			
+			import "os"
+			
+			type hook func() ()
+			
+			func b() () {}
+			
+			func a() (err error) {
+				var f *os.File
+				if cerr := f.Close(); cerr != nil {
+					err = cerr // *
+				}
+				return nil
+			}
+			`,
+	}
+	test(t, tests)
+}
+
+func TestSinks(t *testing.T) {
+	tests := map[string]string{
+		"functions": `package a
+			
+			import (
+				"log"
+				"net/http"
+			)
+			
+			func f() error { return nil }
+			
+			func a(w http.ResponseWriter, logger *log.Logger) {
+				if err := f(); err != nil {
+					http.Error(w, err.Error(), 500) // *
+					return                          // *
+				}
+				if err := f(); err != nil {
+					logger.Println(err) // *
+				}
+				if err := f(); err != nil {
+					log.Println(err)
+					return
+				}
+				if err := f(); err != nil {
+					http.Error(w, "", 500)
+					return
+				}
+			}
+			`,
+		"channels": `package a
+			
+			import "fmt"
+			
+			func f() error { return nil }
+			
+			func a(errCh chan error) {
+				for i := 0; i < 10; i++ {
+					if err := f(); err != nil {
+						errCh <- fmt.Errorf("a: %w", err) // *
+						continue                         // *
+					}
+				}
+			}
+			`,
+		"append": `package a
+			
+			type T struct {
+				errs []error
+			}
+			
+			func f() error { return nil }
+			
+			func (t *T) a() int {
+				for i := 0; i < 10; i++ {
+					if err := f(); err != nil {
+						t.errs = append(t.errs, err) // *
+						continue                     // *
+					}
+				}
+				if err := f(); err != nil {
+					t.errs = append(t.errs, err) // *
+					return 0                     // *
+				}
+				if err := f(); err != nil {
+					t.errs = append(t.errs, err)
+					return 1
+				}
+				return 0
+			}
+			`,
+		"not final": `package a
+			
+			import "net/http"
+			
+			func f() error { return nil }
+			
+			func a(w http.ResponseWriter) {
+				if err := f(); err != nil {
+					http.Error(w, err.Error(), 500)
+					w.WriteHeader(500)
+				}
+			}
+			`,
+	}
+	testSetup(t, func(s *shared.Setup) {
+		s.Sinks = shared.Sinks{
+			Functions: []string{"net/http.Error", "(*log.Logger).Println"},
+			Channels:  true,
+			Append:    true,
+		}
+	}, tests)
+
+	// no sinks are configured by default
+	test(t, map[string]string{
+		"default": `package a
+			
+			func f() error { return nil }
+			
+			func a(errCh chan error) {
+				if err := f(); err != nil {
+					errCh <- err
+					return
+				}
+			}
+			`,
+	})
+}
+
 func TestBool(t *testing.T) {
 	tests := map[string]string{
 		"wrap1": `package a
@@ -367,296 +894,1479 @@ func TestBool(t *testing.T) {
 	test(t, tests)
 }
 
-func TestGeneral(t *testing.T) {
+func TestCompositeWrap(t *testing.T) {
 	tests := map[string]string{
-		"simple": `package a
+		"pointer literal": `package a
 			
-			import "fmt"
+			import "os"
+			
+			func f() error { return nil }
 			
 			func a() error {
-				_, err := fmt.Println()
-				if err != nil {
-					return err // *
+				if err := f(); err != nil {
+					return &os.PathError{Op: "open", Err: err} // *
 				}
 				return nil
 			}
 			`,
-		"wrong way round": `package a
+		"value literal": `package a
 			
-			import "fmt"
+			type MyErr struct{ Cause error }
 			
-			func a() error {
-				_, err := fmt.Println()
-				if nil != err {
-					return err // *
+			func (MyErr) Error() string { return "" }
+			
+			func f() error { return nil }
+			
+			func a() (int, error) {
+				if err := f(); err != nil {
+					return 0, MyErr{err} // *
 				}
-				return nil
+				return 0, nil
 			}
 			`,
-		"not else block": `package a
+		"nested": `package a
 			
 			import "fmt"
 			
+			type QueryError struct{ Err error }
+			
+			func (*QueryError) Error() string { return "" }
+			
+			func f() error { return nil }
+			
 			func a() error {
-				_, err := fmt.Println()
-				if err != nil {
-					return err // *
-				} else {
-					return err
+				if err := f(); err != nil {
+					return &QueryError{Err: fmt.Errorf("query: %w", err)} // *
 				}
 				return nil
 			}
 			`,
-		"any name": `package a
+		"non-error call field": `package a
 			
 			import "fmt"
 			
-			func a() error {
-				_, foo := fmt.Println()
-				if foo != nil {
-					return foo // *
+			type QueryError struct {
+				Query string
+				Err   error
+			}
+			
+			func (*QueryError) Error() string { return "" }
+			
+			func f() error { return nil }
+			
+			func describe(err error) string { return fmt.Sprint(err) }
+			
+			func a(q fmt.Stringer) error {
+				if err := f(); err != nil {
+					return &QueryError{Query: q.String(), Err: err} // *
+				}
+				if err := f(); err != nil {
+					return &QueryError{Query: describe(err)}
 				}
 				return nil
 			}
 			`,
-		"don't mark if ==": `package a
+		"assign and declare": `package a
 			
-			import "fmt"
+			import "os"
+			
+			func f() error { return nil }
 			
 			func a() error {
-				_, err := fmt.Println()
-				if err == nil {
-					return err
+				if err := f(); err != nil {
+					e := &os.PathError{Err: err}
+					return e // *
+				}
+				if err := f(); err != nil {
+					var e error = &os.PathError{Err: err}
+					return e // *
 				}
 				return nil
 			}
 			`,
-		"use else block if err == nil": `package a
+		"not an error": `package a
 			
-			import "fmt"
+			type T struct{ Err error }
+			
+			func f() error { return nil }
+			
+			func a() (*T, error) {
+				if err := f(); err != nil {
+					return &T{Err: err}, nil
+				}
+				return nil, nil
+			}
+			`,
+		"different error": `package a
+			
+			import "os"
+			
+			func f() error { return nil }
 			
 			func a() error {
-				_, err := fmt.Println()
-				if err == nil {
-					return err
-				} else {
-					return err // *
+				var other error
+				if err := f(); err != nil {
+					return &os.PathError{Err: other}
 				}
 				return nil
 			}
 			`,
-		"support if with init form": `package a
+	}
+	test(t, tests)
+}
+
+func TestErrorsIsAs(t *testing.T) {
+	tests := map[string]string{
+		"is": `package a
 			
-			import "fmt"
+			import (
+				"errors"
+				"fmt"
+				"io/fs"
+			)
+			
+			func f() error { return nil }
+			
+			func a() (*int, error) {
+				err := f()
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil, err // *
+				}
+				if errors.Is(err, fs.ErrExist) && 1 == 1 {
+					return nil, fmt.Errorf("exists: %w", err) // *
+				}
+				return nil, nil
+			}
+			`,
+		"as": `package a
+			
+			import (
+				"errors"
+				"io/fs"
+			)
+			
+			func f() error { return nil }
 			
 			func a() error {
-				if _, err := fmt.Println(); err != nil {
+				err := f()
+				var pe *fs.PathError
+				if errors.As(err, &pe) {
 					return err // *
 				}
 				return nil
 			}
 			`,
-		"only in if block": `package foo
+		"not excluded": `package a
 			
-			import "fmt"
+			import "errors"
 			
-			func Baz() error {
-				return fmt.Errorf("foo")
+			var sentinel = errors.New("")
+			
+			func f() error { return nil }
+			
+			func a() error {
+				err := f()
+				if !errors.Is(err, sentinel) {
+					return err
+				}
+				if errors.Is(err, nil) {
+					return err
+				}
+				if errors.Is(err, sentinel) || 1 == 1 {
+					return err
+				}
+				return nil
 			}
 			`,
-	}
-	test(t, tests)
-}
-
-func TestZeroValues(t *testing.T) {
-	tests := map[string]string{
-		"only return if all other return vars are zero": `package a
+		"nil target": `package a
 			
-			import "fmt"
+			import "errors"
 			
-			type iface interface{}
+			var target error
 			
-			type strct struct {
-				a int
-				b string
+			var reset = errors.New("")
+			
+			func init() {
+				reset = nil
 			}
 			
-			func Foo() (iface, bool, int, string, float32, strct, strct, error) {
-				if _, err := fmt.Println(); err != nil {
-					return 1, false, 0, "", 0.0, strct{0, ""}, strct{a: 0, b: ""}, err
-				}
-				if _, err := fmt.Println(); err != nil {
-					return nil, true, 0, "", 0.0, strct{0, ""}, strct{a: 0, b: ""}, err
+			type T struct{ Err error }
+			
+			func f() error { return nil }
+			
+			func a(t T) error {
+				err := f()
+				if errors.Is(err, target) {
+					return err
 				}
-				if _, err := fmt.Println(); err != nil {
-					return nil, false, 1, "", 0.0, strct{0, ""}, strct{a: 0, b: ""}, err
+				if errors.Is(err, reset) {
+					return err
 				}
-				if _, err := fmt.Println(); err != nil {
-					return nil, false, 0, "a", 0.0, strct{0, ""}, strct{a: 0, b: ""}, err
+				if errors.Is(err, t.Err) {
+					return err
 				}
-				if _, err := fmt.Println(); err != nil {
-					return nil, false, 0, "", 1.0, strct{0, ""}, strct{a: 0, b: ""}, err
+				if errors.Is(err, f()) {
+					return err
 				}
-				if _, err := fmt.Println(); err != nil {
-					return nil, false, 0, "", 0.0, strct{1, ""}, strct{a: 0, b: ""}, err
+				return nil
+			}
+			`,
+		"non-nil targets": `package a
+			
+			import (
+				"errors"
+				"fmt"
+				"io"
+			)
+			
+			type MyErr string
+			
+			func (MyErr) Error() string { return "" }
+			
+			const constErr = MyErr("const")
+			
+			var (
+				wrapped  = fmt.Errorf("wrapped")
+				indirect = wrapped
+			)
+			
+			func f() error { return nil }
+			
+			func a() error {
+				err := f()
+				if errors.Is(err, io.EOF) {
+					return err // *
 				}
-				if _, err := fmt.Println(); err != nil {
-					return nil, false, 0, "", 0.0, strct{0, "a"}, strct{a: 0, b: ""}, err
+				if errors.Is(err, constErr) {
+					return err // *
 				}
-				if _, err := fmt.Println(); err != nil {
-					return nil, false, 0, "", 0.0, strct{0, ""}, strct{a: 1, b: ""}, err
+				if errors.Is(err, &MyErrPtr{}) {
+					return err // *
 				}
-				if _, err := fmt.Println(); err != nil {
-					return nil, false, 0, "", 0.0, strct{0, ""}, strct{a: 0, b: "a"}, err
+				if errors.Is(err, indirect) {
+					return err // *
 				}
-				if _, err := fmt.Println(); err != nil {
-					return nil, false, 0, "", 0.0, strct{0, ""}, strct{a: 0, b: ""}, err // *
+				if errors.Is(err, errors.New("")) {
+					return err // *
 				}
-				return nil, false, 0, "", 0.0, strct{0, ""}, strct{a: 0, b: ""}, nil
+				return nil
 			}
+			
+			type MyErrPtr struct{}
+			
+			func (*MyErrPtr) Error() string { return "" }
 			`,
-	}
-	test(t, tests)
-}
-
-func TestSelectorExpressions(t *testing.T) {
-	tests := map[string]string{
-		"selector expression": `package foo
+		"else block": `package a
 			
-			func Baz() error { 
-				type T struct {
-					Err error
-				}
-				var b T
-				if b.Err != nil {   
-					return b.Err // *
+			import "errors"
+			
+			var sentinel = errors.New("")
+			
+			func f() error { return nil }
+			
+			func a() error {
+				err := f()
+				if !errors.Is(err, sentinel) {
+					return nil
+				} else {
+					return err // *
 				}
-				return nil
 			}
 			`,
 	}
 	test(t, tests)
 }
 
-func TestFunctionExpressions(t *testing.T) {
-	tests := map[string]string{
-		"function expression": `package foo
+func TestCancel(t *testing.T) {
+	source := `package a
+			
+			import (
+				"context"
+				"fmt"
+			)
+			
+			func a(ctx context.Context, c chan int) (*int, error) {
+				for {
+					select {
+					case <-ctx.Done():
+						return nil, ctx.Err() // *
+					case <-c:
+					}
+				}
+			}
 			
-			func Baz() error { 
-				var f func(int) error
-				if f(5) != nil {   
-					return f(5) // *
+			func b(ctx context.Context, c chan int) error {
+				select {
+				case <-ctx.Done():
+					fmt.Println("cancelled")
+					return fmt.Errorf("b: %w", ctx.Err()) // *
+				case <-c:
+					return nil
 				}
-				return nil
 			}
-			`,
-		"function expression params": `package foo
 			
-			func Baz() error { 
-				var f func(int) error
-				if f(4) != nil {   
-					return f(5)
+			func c(ctx, other context.Context, c chan int) error {
+				select {
+				case <-ctx.Done():
+					return other.Err()
+				case <-c:
+					return ctx.Err()
 				}
-				return nil
 			}
-			`,
-		"function expression params 2": `package foo
 			
-			func Baz() error { 
-				var f func(...int) error
-				if f(4) != nil {   
-					return f(4, 4)
+			func d(ctx context.Context) error {
+				done := ctx.Done()
+				select {
+				case <-done:
+					return ctx.Err()
 				}
-				return nil
 			}
-			`,
-		"function expression elipsis": `package foo
 			
-			func Baz() error { 
-				var f func(...interface{}) error
-				var a []interface{}
-				if f(a) != nil {   
-					return f(a...)
+			func e(ctx context.Context, c chan int) (int, error) {
+				select {
+				case <-ctx.Done():
+					fmt.Println("cancelled")
+					return 0, nil
+				case i := <-c:
+					return i, nil
 				}
-				return nil
 			}
-			`,
-		"function expression elipsis 2": `package foo
 			
-			func Baz() error { 
-				var f func(...interface{}) error
-				var a []interface{}
-				if f(a) != nil {   
-					return f(a) // *
+			func f(ctx context.Context, c chan int) error {
+				select {
+				case <-ctx.Done():
+					return fmt.Errorf("cancelled")
+				case v, ok := <-c:
+					if !ok {
+						return ctx.Err()
+					}
+					fmt.Println(v)
 				}
 				return nil
 			}
-			`,
-	}
-	test(t, tests)
-}
-
-func TestPanic(t *testing.T) {
-	tests := map[string]string{
-		"panic": `package foo
 			
-			func Baz() error {
-				panic("") // *
+			func g(ctx context.Context, c chan error) error {
+				select {
+				case <-ctx.Done():
+					return context.Cause(ctx)
+				case err := <-c:
+					return err
+				}
 			}
-			`,
-	}
-	test(t, tests)
+			`
+	testSetup(t, func(s *shared.Setup) {
+		s.Rules = map[shared.Rule]bool{shared.RuleCancel: true}
+	}, map[string]string{"cancel": source})
 }
 
-func TestComments(t *testing.T) {
-	tests := map[string]string{
-		"scope": `package foo
+func TestDataflow(t *testing.T) {
+	source := `package a
 			
-			func Baz() int { 
-				i := 1       
-				if i > 1 {   
-					return i 
-				}            
-				             
-				//notest
-				             // *
-				if i > 2 {   // *
-					return i // *
-				}            // *
-				return 0     // *
-			}
-			`,
-		"scope if": `package foo
+			import (
+				"errors"
+				"fmt"
+				"io"
+				"os"
+			)
 			
-			func Baz(i int) int { 
-				if i > 2 {
-					//notest
-					return i // *
+			func a() (int, error) {
+				i, err := fmt.Println()
+				if err != nil {
+					return 0, err // *
 				}
-				return 0
+				return i, nil
 			}
-			`,
-		"scope file": `package foo
 			
-			//notest
-			                      // *
-			func Baz(i int) int { // *
-				if i > 2 {        // *
-					return i      // *
-				}                 // *
-				return 0          // *
-			}                     // *
-			                      // *
-			func Foo(i int) int { // *
-				return 0          // *
+			func b(name string) error {
+				f, err := os.Open(name)
+				if err != nil {
+					goto fail // *
+				}
+				err = f.Close()
+				if err != nil {
+					goto fail // *
+				}
+				return nil
+			fail:
+				fmt.Println("failed")
+				return err // *
 			}
-			`,
-		"complex comments": `package foo
 			
-			type Logger struct {
-				Enabled bool
+			func c() error {
+				var err error
+				for {
+					_, err = fmt.Println()
+					if err != nil {
+						break // *
+					}
+				}
+				fmt.Println("cleanup")
+				return fmt.Errorf("c: %w", err) // *
 			}
-			func (l Logger) Print(i ...interface{}) {}
+			
+			func d(n int) error {
+				var err error
+				for i := 0; i < n; i++ {
+					_, err = fmt.Println()
+					if err != nil {
+						break
+					}
+				}
+				return err
+			}
+			
+			func e() error {
+				_, err := fmt.Println()
+				if err == nil {
+					return nil
+				}
+				fmt.Println("cleanup")
+				return err // *
+			}
+			
+			func f() error {
+				_, err := fmt.Println()
+				if err != nil {
+					fmt.Println("failed")
+				}
+				return err
+			}
+			
+			func g() error {
+				return fmt.Errorf("g")
+			}
+			
+			func h() func() error {
+				return func() error {
+					_, err := fmt.Println()
+					if err != nil {
+						fmt.Println("failed") // *
+						return err // *
+					}
+					return nil
+				}
+			}
+			
+			func i() error {
+				_, err := fmt.Println()
+				if !(err == nil) {
+					fmt.Println("failed") // *
+				} else {
+					return nil
+				}
+				return err // *
+			}
+			
+			func j() (int, error) {
+				_, err := fmt.Println()
+				if err != nil {
+					fmt.Println("failed")
+					return 1, err
+				}
+				return 0, nil
+			}
+			
+			func ignore(err error) error {
+				return nil
+			}
+			
+			func filter(err error) error {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+			
+			func l() error {
+				_, err := fmt.Println()
+				if err != nil {
+					fmt.Println("failed")
+					return ignore(err)
+				}
+				if err != nil {
+					fmt.Println("failed")
+					return filter(err)
+				}
+				if err != nil {
+					fmt.Println("failed")
+					return fmt.Errorf("l: %v", err)
+				}
+				if err != nil {
+					fmt.Println("failed") // *
+					return errors.Join(err) // *
+				}
+				return nil
+			}
+			
+			func k() (string, bool, *int, error) {
+				_, err := fmt.Println()
+				if err != nil {
+					fmt.Println("failed") // *
+					return "", false, nil, err // *
+				}
+				return "", true, nil, nil
+			}
+			
+			func m(n int) error {
+				_, err := fmt.Println()
+				if err == nil {
+					fmt.Println("ok")
+				} else if n > 0 {
+					fmt.Println("failed") // *
+					return err // *
+				} else {
+					return err // *
+				}
+				return nil
+			}
+			
+			func Get[T any](name string) (*T, error) {
+				f, err := os.Open(name)
+				if err != nil {
+					goto fail // *
+				}
+				err = f.Close()
+				if err != nil {
+					goto fail // *
+				}
+				return new(T), nil
+			fail:
+				fmt.Println("failed")
+				return nil, err // *
+			}
+			
+			type Box[T any] struct {
+				v T
+			}
+			
+			func (b *Box[T]) Get(name string) (T, error) {
+				var zero T
+				f, err := os.Open(name)
+				if err != nil {
+					goto fail // *
+				}
+				err = f.Close()
+				if err != nil {
+					goto fail // *
+				}
+				return b.v, nil
+			fail:
+				fmt.Println("failed")
+				return zero, err // *
+			}
+			`
+	testSetup(t, func(s *shared.Setup) {
+		s.Rules = map[shared.Rule]bool{shared.RuleDataflow: true, shared.RuleError: false}
+	}, map[string]string{"dataflow": source})
+
+	// with the strict option, only errors from other modules are excluded
+	testSetup(t, func(s *shared.Setup) {
+		s.Rules = map[shared.Rule]bool{shared.RuleDataflow: true, shared.RuleError: false}
+		s.Strict = true
+	}, map[string]string{"dataflow strict": `package a
+			
+			import (
+				"errors"
+				"fmt"
+				"os"
+			)
+			
+			var errLocal = errors.New("local")
+			
+			func local() error {
+				return errLocal
+			}
+			
+			func a(name string) error {
+				err := os.Remove(name)
+				if err != nil {
+					goto fail // *
+				}
+				return nil
+			fail:
+				fmt.Println("failed")
+				return fmt.Errorf("a: %w", err) // *
+			}
+			
+			func b() error {
+				err := local()
+				if err != nil {
+					goto fail
+				}
+				return nil
+			fail:
+				fmt.Println("failed")
+				return fmt.Errorf("b: %w", err)
+			}
+			`})
+}
+
+func TestStrict(t *testing.T) {
+	source := `package a
+			
+			import (
+				"errors"
+				"fmt"
+				"os"
+			)
+			
+			var errLocal = errors.New("local")
+			
+			func local() error {
+				return errLocal
+			}
+			
+			func a(name string) (*os.File, error) {
+				f, err := os.Open(name)
+				if err != nil {
+					return nil, err // *
+				}
+				return f, nil
+			}
+			
+			func b() error {
+				if err := local(); err != nil {
+					return err
+				}
+				return nil
+			}
+			
+			func c(name string) error {
+				err := local()
+				if err != nil {
+					return err
+				}
+				_, err = os.Stat(name)
+				if err != nil {
+					return err // *
+				}
+				return nil
+			}
+			
+			func d(err error) error {
+				if err != nil {
+					return err
+				}
+				return nil
+			}
+			
+			func e(name string) error {
+				err := os.Remove(name)
+				switch err {
+				case nil:
+					return nil
+				default:
+					return err // *
+				}
+			}
+			
+			func f(name string) error {
+				err := os.Remove(name)
+				switch {
+				case err != nil:
+					return err // *
+				}
+				return nil
+			}
+			
+			func g(name string) error {
+				err := os.Remove(name)
+				switch err.(type) {
+				case *os.PathError:
+					return err // *
+				}
+				return nil
+			}
+			
+			func h() error {
+				err := local()
+				switch {
+				case err != nil:
+					return err
+				}
+				return nil
+			}
+			
+			func i(name string) error {
+				err := fmt.Errorf("i: %w", local())
+				if err != nil {
+					return err
+				}
+				err = fmt.Errorf("i: %w", fmt.Errorf("wrapped: %w", local()))
+				if err != nil {
+					return err
+				}
+				err = fmt.Errorf("i: %w", os.Remove(name))
+				if err != nil {
+					return err // *
+				}
+				return nil
+			}
+			
+			func j(name string) error {
+				err := local()
+				err = fmt.Errorf("j: %w", err)
+				if err != nil {
+					return err
+				}
+				err = os.Remove(name)
+				err = fmt.Errorf("j: %w", err)
+				if err != nil {
+					return err // *
+				}
+				return nil
+			}
+			
+			func k(name string, c bool) error {
+				err := local()
+				if c {
+					err = os.Remove(name)
+				}
+				if err != nil {
+					return err
+				}
+				err = os.Remove(name)
+				if c {
+					err = os.Remove(name + "~")
+				}
+				if err != nil {
+					return err // *
+				}
+				return nil
+			}
+			
+			func l(names []string) error {
+				var err error
+				for _, name := range names {
+					if err != nil {
+						return err
+					}
+					err = local()
+					if err == nil {
+						err = os.Remove(name)
+					}
+				}
+				return nil
+			}
+			
+			func m(err error, name string) error {
+				if err != nil {
+					return err
+				}
+				if name != "" {
+					err = os.Remove(name)
+				}
+				if err != nil {
+					return err
+				}
+				err = os.Remove(name)
+				if err != nil {
+					return err // *
+				}
+				return nil
+			}
+			
+			func n(name string) func() error {
+				err := os.Remove(name)
+				return func() error {
+					if err != nil {
+						return err // *
+					}
+					return nil
+				}
+			}
+			`
+	testSetup(t, func(s *shared.Setup) {
+		s.Strict = true
+	}, map[string]string{"strict": source})
+}
+
+func TestGeneral(t *testing.T) {
+	tests := map[string]string{
+		"simple": `package a
+			
+			import "fmt"
+			
+			func a() error {
+				_, err := fmt.Println()
+				if err != nil {
+					return err // *
+				}
+				return nil
+			}
+			`,
+		"wrong way round": `package a
+			
+			import "fmt"
+			
+			func a() error {
+				_, err := fmt.Println()
+				if nil != err {
+					return err // *
+				}
+				return nil
+			}
+			`,
+		"not else block": `package a
+			
+			import "fmt"
+			
+			func a() error {
+				_, err := fmt.Println()
+				if err != nil {
+					return err // *
+				} else {
+					return err
+				}
+				return nil
+			}
+			`,
+		"any name": `package a
+			
+			import "fmt"
+			
+			func a() error {
+				_, foo := fmt.Println()
+				if foo != nil {
+					return foo // *
+				}
+				return nil
+			}
+			`,
+		"don't mark if ==": `package a
+			
+			import "fmt"
+			
+			func a() error {
+				_, err := fmt.Println()
+				if err == nil {
+					return err
+				}
+				return nil
+			}
+			`,
+		"use else block if err == nil": `package a
+			
+			import "fmt"
+			
+			func a() error {
+				_, err := fmt.Println()
+				if err == nil {
+					return err
+				} else {
+					return err // *
+				}
+				return nil
+			}
+			`,
+		"support if with init form": `package a
+			
+			import "fmt"
+			
+			func a() error {
+				if _, err := fmt.Println(); err != nil {
+					return err // *
+				}
+				return nil
+			}
+			`,
+		"only in if block": `package foo
+			
+			import "fmt"
+			
+			func Baz() error {
+				return fmt.Errorf("foo")
+			}
+			`,
+	}
+	test(t, tests)
+}
+
+func TestErrorTypes(t *testing.T) {
+	tests := map[string]string{
+		"concrete error type": `package a
+			
+			type MyError struct{}
+			
+			func (*MyError) Error() string { return "" }
+			
+			func f() *MyError { return nil }
+			
+			func a() error {
+				if err := f(); err != nil {
+					return err // *
+				}
+				return nil
+			}
+			
+			func b() *MyError {
+				if err := f(); err != nil {
+					return err // *
+				}
+				return nil
+			}
+			
+			func c() (int, *MyError) {
+				if err := f(); err != nil {
+					return 0, err // *
+				}
+				return 0, nil
+			}
+			`,
+		"named interface": `package a
+			
+			type Error interface {
+				error
+				Code() int
+			}
+			
+			func f() Error { return nil }
+			
+			func wrap(error) Error { return nil }
+			
+			func a() Error {
+				err := f()
+				if err != nil {
+					return wrap(err) // *
+				}
+				return nil
+			}
+			`,
+		"value receiver": `package a
+			
+			type MyError string
+			
+			func (MyError) Error() string { return "" }
+			
+			func a(e MyError) error {
+				if e != "" {
+					return e
+				}
+				return nil
+			}
+			`,
+		"not an error": `package a
+			
+			type T struct{}
+			
+			func f() *T { return nil }
+			
+			func a() *T {
+				if t := f(); t != nil {
+					return t
+				}
+				return nil
+			}
+			`,
+	}
+	test(t, tests)
+}
+
+func TestZeroValues(t *testing.T) {
+	tests := map[string]string{
+		"only return if all other return vars are zero": `package a
+			
+			import "fmt"
+			
+			type iface interface{}
+			
+			type strct struct {
+				a int
+				b string
+			}
+			
+			func Foo() (iface, bool, int, string, float32, strct, strct, error) {
+				if _, err := fmt.Println(); err != nil {
+					return 1, false, 0, "", 0.0, strct{0, ""}, strct{a: 0, b: ""}, err
+				}
+				if _, err := fmt.Println(); err != nil {
+					return nil, true, 0, "", 0.0, strct{0, ""}, strct{a: 0, b: ""}, err
+				}
+				if _, err := fmt.Println(); err != nil {
+					return nil, false, 1, "", 0.0, strct{0, ""}, strct{a: 0, b: ""}, err
+				}
+				if _, err := fmt.Println(); err != nil {
+					return nil, false, 0, "a", 0.0, strct{0, ""}, strct{a: 0, b: ""}, err
+				}
+				if _, err := fmt.Println(); err != nil {
+					return nil, false, 0, "", 1.0, strct{0, ""}, strct{a: 0, b: ""}, err
+				}
+				if _, err := fmt.Println(); err != nil {
+					return nil, false, 0, "", 0.0, strct{1, ""}, strct{a: 0, b: ""}, err
+				}
+				if _, err := fmt.Println(); err != nil {
+					return nil, false, 0, "", 0.0, strct{0, "a"}, strct{a: 0, b: ""}, err
+				}
+				if _, err := fmt.Println(); err != nil {
+					return nil, false, 0, "", 0.0, strct{0, ""}, strct{a: 1, b: ""}, err
+				}
+				if _, err := fmt.Println(); err != nil {
+					return nil, false, 0, "", 0.0, strct{0, ""}, strct{a: 0, b: "a"}, err
+				}
+				if _, err := fmt.Println(); err != nil {
+					return nil, false, 0, "", 0.0, strct{0, ""}, strct{a: 0, b: ""}, err // *
+				}
+				return nil, false, 0, "", 0.0, strct{0, ""}, strct{a: 0, b: ""}, nil
+			}
+			`,
+		"generics": `package a
+			
+			func f() error { return nil }
+			
+			func Foo[T any, N ~int]() (T, error) {
+				var zero T
+				if err := f(); err != nil {
+					return zero, err // *
+				}
+				if err := f(); err != nil {
+					return *new(T), err // *
+				}
+				if _, err := Bar[N](); err != nil {
+					return zero, err // *
+				}
+				return zero, nil
+			}
+			
+			func Bar[N ~int]() (N, error) {
+				if err := f(); err != nil {
+					return N(0), err // *
+				}
+				if err := f(); err != nil {
+					return N(1), err
+				}
+				return 0, nil
+			}
+			`,
+		"conversions": `package a
+			
+			type ID int
+			
+			func f() error { return nil }
+			
+			func Foo() (ID, []int, error) {
+				if err := f(); err != nil {
+					return ID(0), []int(nil), err // *
+				}
+				return 0, nil, nil
+			}
+			`,
+		"zero variables": `package a
+			
+			type T struct{ i int }
+			
+			func (t *T) Set() { t.i = 1 }
+			
+			func f() error { return nil }
+			
+			func Foo(p T) (T, error) {
+				var a T
+				var b = T{}
+				var c T
+				var d T
+				var e T
+				var g T
+				h := T{}
+				if err := f(); err != nil {
+					return a, err // *
+				}
+				if err := f(); err != nil {
+					return b, err // *
+				}
+				if err := f(); err != nil {
+					return h, err // *
+				}
+				// values that can't be checked are assumed to be zero,
+				// including variables changed after their declaration
+				if err := f(); err != nil {
+					return p, err // *
+				}
+				c = p
+				if err := f(); err != nil {
+					return c, err // *
+				}
+				d.Set()
+				if err := f(); err != nil {
+					return d, err // *
+				}
+				func() { e.i++ }()
+				if err := f(); err != nil {
+					return e, err // *
+				}
+				_ = &g
+				if err := f(); err != nil {
+					return g, err // *
+				}
+				return a, nil
+			}
+			
+			func g() (int, error) { return 0, nil }
+			
+			func Baz(t T) (int, error) {
+				x, err := g()
+				if err != nil {
+					return x, err // *
+				}
+				if err := f(); err != nil {
+					return t.i, err // *
+				}
+				y := 5
+				if err := f(); err != nil {
+					return y, err
+				}
+				z := 5
+				z, err = g()
+				if err != nil {
+					return z, err // *
+				}
+				var n int
+				n, err = g()
+				if err != nil {
+					return n, err // *
+				}
+				return x, nil
+			}
+			
+			func Bar() ([2]int, error) {
+				var arr [2]int
+				s := arr[:]
+				s[0] = 1
+				if err := f(); err != nil {
+					return arr, err // *
+				}
+				return arr, nil
+			}
+			`,
+	}
+	test(t, tests)
+}
+
+func TestSelectorExpressions(t *testing.T) {
+	tests := map[string]string{
+		"selector expression": `package foo
+			
+			func Baz() error { 
+				type T struct {
+					Err error
+				}
+				var b T
+				if b.Err != nil {   
+					return b.Err // *
+				}
+				return nil
+			}
+			`,
+	}
+	test(t, tests)
+}
+
+func TestFunctionExpressions(t *testing.T) {
+	tests := map[string]string{
+		"function expression": `package foo
+			
+			func Baz() error { 
+				var f func(int) error
+				if f(5) != nil {   
+					return f(5) // *
+				}
+				return nil
+			}
+			`,
+		"function expression params": `package foo
+			
+			func Baz() error { 
+				var f func(int) error
+				if f(4) != nil {   
+					return f(5)
+				}
+				return nil
+			}
+			`,
+		"function expression params 2": `package foo
+			
+			func Baz() error { 
+				var f func(...int) error
+				if f(4) != nil {   
+					return f(4, 4)
+				}
+				return nil
+			}
+			`,
+		"function expression elipsis": `package foo
+			
+			func Baz() error { 
+				var f func(...interface{}) error
+				var a []interface{}
+				if f(a) != nil {   
+					return f(a...)
+				}
+				return nil
+			}
+			`,
+		"function expression elipsis 2": `package foo
+			
+			func Baz() error { 
+				var f func(...interface{}) error
+				var a []interface{}
+				if f(a) != nil {   
+					return f(a) // *
+				}
+				return nil
+			}
+			`,
+	}
+	test(t, tests)
+}
+
+func TestPanic(t *testing.T) {
+	tests := map[string]string{
+		"panic": `package foo
+			
+			func Baz() error {
+				panic("") // *
+			}
+			`,
+	}
+	test(t, tests)
+}
+
+func TestRecover(t *testing.T) {
+	tests := map[string]string{
+		"recover": `package foo
+			
+			import "fmt"
+			
+			func Baz() (err error) {
+				defer func() {
+					if r := recover(); r != nil {
+						err = fmt.Errorf("panic: %v", r) // *
+					}
+				}()
+				defer func() {
+					r := recover()
+					fmt.Println()
+					if nil != r {
+						fmt.Println(r) // *
+						return         // *
+					}
+				}()
+				defer func() {
+					if recover() != nil {
+						fmt.Println() // *
+					}
+				}()
+				return nil
+			}
+			`,
+		"not deferred": `package foo
+			
+			import "fmt"
+			
+			func Baz() {
+				if r := recover(); r != nil {
+					fmt.Println(r)
+				}
+				func() {
+					if r := recover(); r != nil {
+						fmt.Println(r)
+					}
+				}()
+			}
+			`,
+		"nested function": `package foo
+			
+			import "fmt"
+			
+			func Baz() {
+				defer func() {
+					func() {
+						if r := recover(); r != nil {
+							fmt.Println(r)
+						}
+					}()
+				}()
+			}
+			`,
+		"other condition": `package foo
+			
+			import "fmt"
+			
+			func Baz() {
+				defer func() {
+					r := recover()
+					if r == nil {
+						fmt.Println(r)
+					}
+				}()
+			}
+			`,
+	}
+	test(t, tests)
+}
+
+func TestExit(t *testing.T) {
+	tests := map[string]string{
+		"exit": `package foo
+			
+			import (
+				"log"
+				"os"
+				"runtime"
+			)
+			
+			func Baz(i int) {
+				if i > 1 {
+					log.Fatal("") // *
+				}
+				if i > 2 {
+					log.Fatalf("") // *
+				}
+				if i > 3 {
+					log.Panic("") // *
+				}
+				if i > 4 {
+					os.Exit(1) // *
+				}
+				if i > 5 {
+					runtime.Goexit() // *
+				}
+				var l *log.Logger
+				l.Fatalln("") // *
+			}
+			`,
+		"local variable": `package foo
+			
+			type logger struct{}
+			
+			func (logger) Fatal(...interface{}) {}
+			
+			func Baz() {
+				var log logger
+				log.Fatal("")
+			}
+			`,
+		"shadowed panic": `package foo
+			
+			func Baz() {
+				panic := func(string) {}
+				panic("")
+			}
+			`,
+	}
+	test(t, tests)
+}
+
+func TestExitTerminators(t *testing.T) {
+	tests := map[string]string{
+		"terminators": `package a
+			
+			type must struct{}
+			
+			func (*must) Die() {}
+			
+			func die() {}
+			
+			func Baz(i int) {
+				if i > 1 {
+					die() // *
+				}
+				var m *must
+				m.Die() // *
+			}
+			`,
+	}
+	testSetup(t, func(s *shared.Setup) {
+		s.Terminators = []string{"ns/a.die", "(*ns/a.must).Die"}
+	}, tests)
+}
+
+func TestGenerated(t *testing.T) {
+	source := `// Code generated by stringer; DO NOT EDIT.
+
+		package foo
+		
+		func Baz(i int) int {
+			if i > 1 {
+				return i
+			}
+			return 0
+		}
+		`
+	cm, pdir := scan(t, "generated", nil, source)
+	reasons := cm.Reasons[filepath.Join(pdir, "a.go")]
+	for i := range strings.Split(source, "\n") {
+		if !reflect.DeepEqual(reasons[i+1], []shared.Rule{shared.RuleGenerated}) {
+			t.Fatalf("Unexpected reasons in generated, line %d: %v", i+1, reasons[i+1])
+		}
+	}
+
+	cm, pdir = scan(t, "generated disabled", func(s *shared.Setup) {
+		s.Rules = map[shared.Rule]bool{shared.RuleGenerated: false}
+	}, source)
+	if len(cm.Excludes[filepath.Join(pdir, "a.go")]) > 0 {
+		t.Fatalf("Unexpected excludes in generated disabled: %v", cm.Excludes[filepath.Join(pdir, "a.go")])
+	}
+
+	test(t, map[string]string{
+		"not generated": `// Code generated by hand.
+
+		package foo
+		
+		func Baz() int {
+			return 0
+		}
+		`,
+	})
+}
+
+func TestComments(t *testing.T) {
+	tests := map[string]string{
+		"scope": `package foo
+			
+			func Baz() int { 
+				i := 1       
+				if i > 1 {   
+					return i 
+				}            
+				             
+				//notest
+				             // *
+				if i > 2 {   // *
+					return i // *
+				}            // *
+				return 0     // *
+			}
+			`,
+		"scope if": `package foo
+			
+			func Baz(i int) int { 
+				if i > 2 {
+					//notest
+					return i // *
+				}
+				return 0
+			}
+			`,
+		"scope file": `package foo
+			
+			//notest
+			                      // *
+			func Baz(i int) int { // *
+				if i > 2 {        // *
+					return i      // *
+				}                 // *
+				return 0          // *
+			}                     // *
+			                      // *
+			func Foo(i int) int { // *
+				return 0          // *
+			}
+			`,
+		"complex comments": `package foo
+			
+			type Logger struct {
+				Enabled bool
+			}
+			func (l Logger) Print(i ...interface{}) {}
 			
 			func Foo() {
 				var logger Logger
@@ -669,72 +2379,1105 @@ func TestComments(t *testing.T) {
 				}
 			}
 			`,
-		"case block": `package foo
+		"case block": `package foo
+			
+			func Foo() bool {
+				switch {
+				case true:
+					// notest
+					if true {       // *
+						return true // *
+					}               // *
+					return false    // *
+				}
+				return false
+			}
+			`,
+		"case block with explanation comment": `package foo
+			
+			func Foo() bool {
+				switch {
+				case true:
+					// notest // this condition is always true
+					if true {       // *
+						return true // *
+					}               // *
+					return false    // *
+				}
+				return false
+			}
+			`,
+	}
+	test(t, tests)
+}
+
+func TestRules(t *testing.T) {
+	source := `package a
+		
+		import "fmt"
+		
+		func a() error {
+			_, err := fmt.Println()
+			if err != nil {
+				return err // *
+			}
+			panic("")
+		}
+		
+		func b() {
+			// notest
+			fmt.Println()
+		}
+		`
+	cases := map[string]struct {
+		rules    map[shared.Rule]bool
+		expected map[int][]shared.Rule
+	}{
+		"defaults": {
+			rules: nil,
+			expected: map[int][]shared.Rule{
+				8:  {shared.RuleError},
+				10: {shared.RulePanic},
+				14: {shared.RuleNotest},
+				15: {shared.RuleNotest},
+			},
+		},
+		"error disabled": {
+			rules: map[shared.Rule]bool{shared.RuleError: false},
+			expected: map[int][]shared.Rule{
+				10: {shared.RulePanic},
+				14: {shared.RuleNotest},
+				15: {shared.RuleNotest},
+			},
+		},
+		"notest and panic disabled": {
+			rules: map[shared.Rule]bool{shared.RuleNotest: false, shared.RulePanic: false},
+			expected: map[int][]shared.Rule{
+				8: {shared.RuleError},
+			},
+		},
+	}
+	for name, c := range cases {
+		cm, pdir := scan(t, name, func(s *shared.Setup) { s.Rules = c.rules }, source)
+		reasons := cm.Reasons[filepath.Join(pdir, "a.go")]
+		if len(reasons) != len(c.expected) {
+			t.Fatalf("Unexpected reasons in %s: got %v, expected %v", name, reasons, c.expected)
+		}
+		for line, expected := range c.expected {
+			if !reflect.DeepEqual(reasons[line], expected) {
+				t.Fatalf("Unexpected reasons in %s, line %d: got %v, expected %v", name, line, reasons[line], expected)
+			}
+		}
+	}
+}
+
+// TestOptInRules checks each opt-in rule is off by default, using a source
+// the rule excludes code from when it's turned on
+func TestOptInRules(t *testing.T) {
+	sources := map[shared.Rule]string{
+		shared.RuleExhaustive: `package a
+			
+			type State int
+			
+			const (
+				A State = iota
+				B
+			)
+			
+			func a(s State) int {
+				switch s {
+				case A, B:
+					return 1
+				default:
+					return 0
+				}
+			}
+			`,
+		shared.RuleMain: `package main
+			
+			func main() {
+				println("main")
+			}
+			`,
+		shared.RuleInit: `package a
+			
+			func init() {
+				println("init")
+			}
+			`,
+		shared.RuleDeprecated: `package a
+			
+			// Deprecated: use b.
+			func a() {
+				println("a")
+			}
+			`,
+		shared.RuleTrivial: `package a
+			
+			type T struct{ name string }
+			
+			func (t T) Name() string {
+				return t.name
+			}
+			`,
+		shared.RuleConstant: `package a
+			
+			const debug = false
+			
+			func a() {
+				if debug {
+					println("debug")
+				}
+			}
+			`,
+		shared.RuleDataflow: `package a
+			
+			import "fmt"
+			
+			func a() error {
+				_, err := fmt.Println()
+				if err != nil {
+					goto fail
+				}
+				return nil
+			fail:
+				return err
+			}
+			`,
+		shared.RuleCancel: `package a
+			
+			import "context"
+			
+			func a(ctx context.Context, c chan int) error {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-c:
+					return nil
+				}
+			}
+			`,
+	}
+	excluded := func(cm *scanner.CodeMap, pdir string, rule shared.Rule) bool {
+		for _, reasons := range cm.Reasons[filepath.Join(pdir, "a.go")] {
+			for _, r := range reasons {
+				if r == rule {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	for rule, source := range sources {
+		cm, pdir := scan(t, string(rule)+" default", nil, source)
+		if excluded(cm, pdir, rule) {
+			t.Fatalf("Expected %s to be off by default", rule)
+		}
+		cm, pdir = scan(t, string(rule)+" enabled", func(s *shared.Setup) {
+			s.Rules = map[shared.Rule]bool{rule: true}
+		}, source)
+		if !excluded(cm, pdir, rule) {
+			t.Fatalf("Expected %s to exclude code when enabled", rule)
+		}
+	}
+}
+
+func TestRulesUnknown(t *testing.T) {
+	env := vos.Mock()
+	setup := &shared.Setup{
+		Env:   env,
+		Paths: patsy.NewCache(env),
+		Rules: map[shared.Rule]bool{"foo": true},
+	}
+	if err := scanner.New(setup).ScanPackages(); err == nil {
+		t.Fatal("Expected error for unknown rule")
+	}
+}
+
+func TestSelf(t *testing.T) {
+	// courtney's own source mentions the notest directives in comments, so
+	// scanning it checks that prose isn't mistaken for a directive
+	_, file, _, _ := runtime.Caller(0)
+	// other tests leave the working directory in a temporary gopath
+	if err := os.Chdir(filepath.Dir(file)); err != nil {
+		t.Fatalf("Error changing directory: %+v", err)
+	}
+	env := vos.Os()
+	setup := &shared.Setup{
+		Env:   env,
+		Paths: patsy.NewCache(env),
+	}
+	if err := setup.Parse([]string{"github.com/dave/courtney/..."}); err != nil {
+		t.Fatalf("Error parsing args: %+v", err)
+	}
+	cm := scanner.New(setup)
+	if err := cm.LoadProgram(); err != nil {
+		t.Fatalf("Error loading program: %+v", err)
+	}
+	if err := cm.ScanPackages(); err != nil {
+		t.Fatalf("Error scanning packages: %+v", err)
+	}
+}
+
+// scan builds a package containing a single file and returns the scanned
+// CodeMap and the package dir.
+func scan(t *testing.T, name string, configure func(*shared.Setup), source string) (*scanner.CodeMap, string) {
+	cm, pdir := load(t, name, configure, source)
+	if err := cm.ScanPackages(); err != nil {
+		t.Fatalf("Error scanning packages in %s: %+v", name, err)
+	}
+	return cm, pdir
+}
+
+// load builds a package containing a single file and returns the loaded
+// CodeMap and the package dir.
+func load(t *testing.T, name string, configure func(*shared.Setup), source string, rules ...scanner.Rule) (*scanner.CodeMap, string) {
+	env := vos.Mock()
+	b, err := builder.New(env, "ns", true)
+	if err != nil {
+		t.Fatalf("Error creating builder in %s: %+v", name, err)
+	}
+	t.Cleanup(b.Cleanup)
+
+	// the builder's go.mod has no go version, which disables generics
+	if err := os.WriteFile(filepath.Join(b.Root(), "go.mod"), []byte("module ns\n\ngo 1.22\n"), 0666); err != nil {
+		t.Fatalf("Error creating go.mod in %s: %+v", name, err)
+	}
+
+	ppath, pdir, err := b.Package("a", map[string]string{
+		"a.go": source,
+	})
+	if err != nil {
+		t.Fatalf("Error creating package in %s: %+v", name, err)
+	}
+
+	paths := patsy.NewCache(env)
+	setup := &shared.Setup{
+		Env:   env,
+		Paths: paths,
+	}
+	if configure != nil {
+		configure(setup)
+	}
+	if err := setup.Parse([]string{ppath}); err != nil {
+		t.Fatalf("Error parsing args in %s: %+v", name, err)
+	}
+
+	cm := scanner.New(setup, rules...)
+
+	if err := cm.LoadProgram(); err != nil {
+		t.Fatalf("Error loading program in %s: %+v", name, err)
+	}
+	return cm, pdir
+}
+
+func TestRoles(t *testing.T) {
+	tests := map[string]string{
+		"main package": `package main
+			
+			import "fmt"
+			
+			func init() { // *
+				fmt.Println("init") // *
+			} // *
+			
+			func main() { // *
+				fmt.Println(foo()) // *
+			} // *
+			
+			// foo returns a number.
+			//
+			// Deprecated: use bar instead.
+			func foo() int { // *
+				return bar() // *
+			} // *
+			
+			// bar returns a number. Deprecated: this is not a paragraph.
+			func bar() int {
+				return 1
+			}
+			`,
+		"other package": `package foo
+			
+			func main() {
+				println("main")
+			}
+			
+			func init() { // *
+				println("init") // *
+			} // *
+			
+			type T struct{}
+			
+			func (T) init() {
+				println("init")
+			}
+			
+			// Old is kept for compatibility.
+			//
+			// Deprecated: use New.
+			func (T) Old() { // *
+				println("old") // *
+			} // *
+			
+			func New() {
+				// Deprecated: not a doc comment.
+				println("new")
+			}
+			`,
+		"main method": `package main
+			
+			type T struct{}
+			
+			func (T) main() {
+				println("method")
+			}
+			
+			func main() { // *
+				T{}.main() // *
+			} // *
+			`,
+	}
+	testSetup(t, func(s *shared.Setup) {
+		s.Rules = map[shared.Rule]bool{
+			shared.RuleMain:       true,
+			shared.RuleInit:       true,
+			shared.RuleDeprecated: true,
+		}
+	}, tests)
+
+	// each exclusion is tagged with the role
+	cm, pdir := scan(t, "roles", func(s *shared.Setup) {
+		s.Rules = map[shared.Rule]bool{
+			shared.RuleMain:       true,
+			shared.RuleInit:       true,
+			shared.RuleDeprecated: true,
+		}
+	}, tests["main package"])
+	reasons := cm.Reasons[filepath.Join(pdir, "a.go")]
+	for line, expected := range map[int]shared.Rule{6: shared.RuleInit, 10: shared.RuleMain, 17: shared.RuleDeprecated} {
+		if !reflect.DeepEqual(reasons[line], []shared.Rule{expected}) {
+			t.Fatalf("Unexpected reasons in roles, line %d: got %v, expected %v", line, reasons[line], expected)
+		}
+	}
+}
+
+func TestTrivial(t *testing.T) {
+	source := `package foo
+			
+			import (
+				"fmt"
+				"strings"
+			)
+			
+			const prefix = "foo"
+			
+			type T struct {
+				name string
+				tags []string
+			}
+			
+			func (t *T) Name() string { // *
+				return t.name // *
+			} // *
+			
+			func (t T) Prefix() string { // *
+				return prefix + "/" // *
+			} // *
+			
+			func (t T) Label() string { // *
+				return fmt.Sprintf("%s/%s", prefix, t.name) // *
+			} // *
+			
+			func Max() int { // *
+				return 10 // *
+			} // *
+			
+			func (t T) String() string { // *
+				return strings.Join(t.tags, ",") // *
+			} // *
+			
+			func (t *T) Error() string { // *
+				return strings.ToUpper(t.name) // *
+			} // *
+			
+			func (t T) MarshalText() ([]byte, error) { // *
+				return []byte(t.name), nil // *
+			} // *
+			
+			func (t T) Tags() string {
+				return strings.Join(t.tags, ",")
+			}
+			
+			func (t T) First() string {
+				return t.tags[0]
+			}
+			
+			func (t T) Describe() string {
+				s := t.name
+				return s
+			}
+			
+			type U struct{}
+			
+			func (u U) String(i int) string {
+				return strings.Repeat("u", i)
+			}
+			
+			func (u U) MarshalText() ([]byte, int) {
+				return []byte("u"), 0
+			}
+			
+			type V struct{ name string }
+			
+			func (v *V) String() string { // *
+				return strings.ToLower(v.name) // *
+			} // *
+			
+			func (v *V) Error() string {
+				s := strings.ToLower(v.name)
+				return s
+			}
+			
+			func (v *V) Stringer() func() string {
+				return v.String
+			}
+			
+			func String() string {
+				return strings.ToLower("v")
+			}
+			`
+	testSetup(t, func(s *shared.Setup) {
+		s.Rules = map[shared.Rule]bool{shared.RuleTrivial: true}
+	}, map[string]string{"trivial": source})
+}
+
+func TestPatterns(t *testing.T) {
+	source := `package foo
+			
+			import (
+				"errors"
+				"fmt"
+			)
+			
+			var errNilInput = errors.New("nil input")
+			
+			type counter struct{}
+			
+			func (counter) Inc(name string) {}
+			
+			var metrics counter
+			
+			func a(p *int) (int, error) {
+				if p == nil {
+					return 0, errNilInput // *
+				}
+				metrics.Inc("a") // *
+				return *p, nil
+			}
+			
+			func b(p *int) (int, error) {
+				if p == nil {
+					return 0, errors.New("nil")
+				}
+				return *p, nil
+			}
+			
+			func c(p, q *int) (int, error) {
+				if p == nil {
+					fmt.Println("nil")
+					return 0, errNilInput
+				}
+				if q != p {
+					fmt.Println(*p) // *
+				}
+				if q != p {
+					fmt.Println(*q)
+				}
+				return *p, nil
+			}
+			
+			func d(p *int) {
+				if p == nil {
+					fmt.Println("nil") // *
+				} else {
+					fmt.Println("set") // *
+				}
+			}
+			`
+	testSetup(t, func(s *shared.Setup) {
+		s.Patterns = []string{
+			"if $x == nil { return $_, errNilInput }",
+			"metrics.Inc($_)",
+			"if $x != $y { fmt.Println(*$y) }",
+			`if $x == nil { fmt.Println("nil") } else { fmt.Println("set") }`,
+		}
+	}, map[string]string{"patterns": source})
+
+	// the rule can be turned off
+	testSetup(t, func(s *shared.Setup) {
+		s.Patterns = []string{"metrics.Inc($_)"}
+		s.Rules = map[shared.Rule]bool{shared.RulePattern: false}
+	}, map[string]string{"patterns disabled": strings.Replace(source, " // *", "", -1)})
+
+	// wildcards aren't replaced in string literals
+	testSetup(t, func(s *shared.Setup) {
+		s.Patterns = []string{`fmt.Println("$x", $x)`}
+	}, map[string]string{"literals": `package foo
+			
+			import "fmt"
+			
+			func a(i int) {
+				fmt.Println("$x", i) // *
+				fmt.Println("i", i)
+				fmt.Println(` + "`$x`" + `, i)
+			}
+			`})
+
+	// an invalid pattern, or one that matches every expression, is an error
+	for _, src := range []string{"if {", "$x", "$_"} {
+		cm, _ := load(t, "invalid pattern", func(s *shared.Setup) {
+			s.Patterns = []string{src}
+		}, source)
+		if err := cm.ScanPackages(); err == nil {
+			t.Fatalf("Expected error for invalid pattern %q", src)
+		}
+	}
+}
+
+// traceRule is an extra rule that excludes calls to a function named trace
+type traceRule struct{}
+
+func (traceRule) Name() shared.Rule { return "trace" }
+
+func (traceRule) Inspect(pkg *packages.Package, file *ast.File, node ast.Node, exclude func(line int, reason string)) {
+	call, ok := node.(*ast.CallExpr)
+	if !ok {
+		return
+	}
+	if id, ok := call.Fun.(*ast.Ident); ok && id.Name == "trace" {
+		exclude(pkg.Fset.Position(call.Pos()).Line, "debug output")
+	}
+}
+
+func TestExtraRules(t *testing.T) {
+	source := `package foo
+		
+		func trace(s string) {}
+		
+		func Foo(i int) int {
+			if i > 2 {
+				trace("big") // *
+			}
+			return i
+		}
+		`
+	for name, c := range map[string]struct {
+		rules    map[shared.Rule]bool
+		expected map[int][]shared.Rule
+	}{
+		"enabled": {
+			expected: map[int][]shared.Rule{7: {"trace: debug output"}},
+		},
+		"disabled": {
+			rules:    map[shared.Rule]bool{"trace": false},
+			expected: map[int][]shared.Rule{},
+		},
+	} {
+		cm, pdir := load(t, name, func(s *shared.Setup) { s.Rules = c.rules }, source, traceRule{})
+		if err := cm.ScanPackages(); err != nil {
+			t.Fatalf("Error scanning packages in %s: %+v", name, err)
+		}
+		reasons := cm.Reasons[filepath.Join(pdir, "a.go")]
+		if len(reasons) != len(c.expected) {
+			t.Fatalf("Unexpected reasons in %s: got %v, expected %v", name, reasons, c.expected)
+		}
+		for line, expected := range c.expected {
+			if !reflect.DeepEqual(reasons[line], expected) {
+				t.Fatalf("Unexpected reasons in %s, line %d: got %v, expected %v", name, line, reasons[line], expected)
+			}
+		}
+	}
+
+	// extra rules can't use the name of a built in rule
+	cm, _ := load(t, "built in name", nil, source, panicRule{})
+	if err := cm.ScanPackages(); err == nil {
+		t.Fatal("Expected error for extra rule with a built in name")
+	}
+
+	// or the name of another extra rule
+	cm, _ = load(t, "duplicate name", nil, source, traceRule{}, traceRule{})
+	if err := cm.ScanPackages(); err == nil {
+		t.Fatal("Expected error for extra rules with the same name")
+	}
+
+	// the setup passed to New isn't changed
+	var setup *shared.Setup
+	cm, _ = load(t, "setup", func(s *shared.Setup) { setup = s }, source, traceRule{})
+	if err := cm.ScanPackages(); err != nil {
+		t.Fatalf("Error scanning packages in setup: %+v", err)
+	}
+	if len(setup.Extra) != 0 {
+		t.Fatalf("Unexpected extra rules in setup: %v", setup.Extra)
+	}
+}
+
+// panicRule is an extra rule that uses the name of a built in rule
+type panicRule struct{ traceRule }
+
+func (panicRule) Name() shared.Rule { return shared.RulePanic }
+
+func TestIgnoreDirective(t *testing.T) {
+	tests := map[string]string{
+		"function": `package foo
+			
+			func Foo(i int) int {
+				return i
+			}
+			
+			// Bar is ignored
+			//courtney:ignore
+			func Bar(i int) int { // *
+				if i > 2 {        // *
+					return i      // *
+				}                 // *
+				return 0          // *
+			}                     // *
+			
+			func Baz(i int) int {
+				return i
+			}
+			`,
+		"method with explanation": `package foo
 			
-			func Foo() bool {
-				switch {
-				case true:
-					// notest
-					if true {       // *
-						return true // *
-					}               // *
-					return false    // *
+			type T struct{}
+			
+			//courtney:ignore because this is glue code
+			func (T) Bar(i int) int { // *
+				return i              // *
+			}                         // *
+			
+			func Baz(i int) int {
+				return i
+			}
+			`,
+		"not a doc comment": `package foo
+			
+			//courtney:ignore
+			
+			func Bar(i int) int {
+				//courtney:ignore
+				return i
+			}
+			`,
+		"declaration only": `package foo
+			
+			//courtney:ignore
+			func Bar(i int) int
+			`,
+	}
+	test(t, tests)
+}
+
+func TestTrailingComments(t *testing.T) {
+	tests := map[string]string{
+		"statement": `package foo
+			
+			func fallback() int { return 0 }
+			
+			func Baz(i int) int {
+				if i > 1 {
+					return i
 				}
-				return false
+				i = fallback() // notest
+				if i > 2 {
+					return i
+				}
+				return 0
 			}
 			`,
-		"case block with explanation comment": `package foo
+		"multi line statement": `package foo
 			
-			func Foo() bool {
-				switch {
-				case true:
-					// notest // this condition is always true
-					if true {       // *
-						return true // *
-					}               // *
-					return false    // *
+			func Baz(i int) int {
+				if i > 1 { // notest
+					return i // *
+				}            // *
+				return 0
+			}
+			`,
+		"inside statement": `package foo
+			
+			func sum(a ...int) int { return 0 }
+			
+			func Baz(i int) int {
+				i = sum(  // *
+					i, // notest
+					2, // *
+				)      // *
+				return i
+			}
+			`,
+		"else block": `package foo
+			
+			func Baz(i int) int {
+				if i > 1 {
+					return i
+				} else { // notest
+					i++      // *
+				}            // *
+				return 0
+			}
+			`,
+		"if else": `package foo
+			
+			func Baz(i int) int {
+				if i > 1 { // notest
+					return i // *
+				} else {
+					i++
 				}
-				return false
+				return 0
+			}
+			`,
+		"closing brace": `package foo
+			
+			func Baz(i int) int {
+				i++
+				if i > 1 { // *
+					i++    // *
+				} // notest
+				return i
+			}
+			`,
+		"closing brace in loop": `package foo
+			
+			func Baz(i int) int {
+				for i < 10 {
+					if i > 1 {  // *
+						return i // *
+					} // notest
+					i++
+				}
+				return 0
+			}
+			`,
+		"declaration": `package foo
+			
+			var i = 1 // notest
+			
+			func Baz() int {
+				return i
 			}
 			`,
 	}
 	test(t, tests)
 }
 
-func test(t *testing.T, tests map[string]string) {
-	for name, source := range tests {
-		env := vos.Mock()
-		b, err := builder.New(env, "ns", true)
-		if err != nil {
-			t.Fatalf("Error creating builder in %s: %+v", name, err)
-		}
-		defer b.Cleanup()
+func TestRangeComments(t *testing.T) {
+	tests := map[string]string{
+		"statements": `package foo
+			
+			func Baz(i int) int {
+				i++
+				// notest:begin
+				i++      // *
+				i++      // *
+				// notest:end
+				if i > 2 {
+					return i
+				}
+				return 0
+			}
+			`,
+		"declarations": `package foo
+			
+			// notest:begin
+			func A() {} // *
+			            // *
+			func B() {} // *
+			            // *
+			func C() {} // *
+			// notest:end
+			
+			func D() {}
+			`,
+		"with explanation": `package foo
+			
+			func Baz(i int) int {
+				//notest:begin // glue code
+				i++ // *
+				//notest:end
+				return i
+			}
+			`,
+		"with reason": `package foo
+			
+			func Baz(i int) int {
+				// notest:begin: glue code
+				i++ // *
+				// notest:end
+				return i
+			}
+			`,
+	}
+	test(t, tests)
+}
 
-		ppath, pdir, err := b.Package("a", map[string]string{
-			"a.go": source,
-		})
-		if err != nil {
-			t.Fatalf("Error creating package in %s: %+v", name, err)
+func TestRangeCommentsProse(t *testing.T) {
+	source := `package foo
+		
+		func Baz(i int) int {
+			// notest:begin markers must be balanced
+			i++
+			// notest:end comments close the range
+			return i
 		}
+		`
+	cm, pdir := scan(t, "prose", nil, source)
+	if excludes := cm.Excludes[filepath.Join(pdir, "a.go")]; len(excludes) > 0 {
+		t.Fatalf("Unexpected excludes: %v", excludes)
+	}
+}
 
-		paths := patsy.NewCache(env)
-		setup := &shared.Setup{
-			Env:   env,
-			Paths: paths,
+func TestRangeCommentsUnmatched(t *testing.T) {
+	tests := map[string]string{
+		"unmatched begin": `package foo
+			
+			func Baz(i int) int {
+				// notest:begin
+				return i
+			}
+			`,
+		"unmatched end": `package foo
+			
+			func Baz(i int) int {
+				// notest:end
+				return i
+			}
+			`,
+		"nested begin": `package foo
+			
+			func Baz(i int) int {
+				// notest:begin
+				// notest:begin
+				return i
+				// notest:end
+			}
+			`,
+	}
+	for name, source := range tests {
+		cm, _ := load(t, name, nil, source)
+		if err := cm.ScanPackages(); err == nil {
+			t.Fatalf("Expected error in %s", name)
 		}
-		if err := setup.Parse([]string{ppath}); err != nil {
-			t.Fatalf("Error parsing args in %s: %+v", name, err)
+
+		// ranges aren't checked when the notest rule is off
+		cm, _ = load(t, name, func(s *shared.Setup) {
+			s.Rules = map[shared.Rule]bool{shared.RuleNotest: false}
+		}, source)
+		if err := cm.ScanPackages(); err != nil {
+			t.Fatalf("Error scanning packages in %s with notest disabled: %+v", name, err)
 		}
+	}
+}
 
-		cm := scanner.New(setup)
+func TestAudit(t *testing.T) {
+	tests := map[string]string{
+		"reasons": `package foo
+			
+			func Baz(i int) int {
+				if i > 1 {
+					// notest: only happens in production
+					return i // *
+				}
+				if i > 2 {
+					// notest(2999-01-01): waiting on upstream fix
+					return i // *
+				}
+				if i > 3 {
+					// notest // this condition is always true
+					return i // *
+				}
+				i++ // notest: glue code
+				// notest:begin(2999-01-01): glue code
+				i++ // *
+				// notest:end
+				return 0
+			}
+			
+			// Glue is only run in production
+			//courtney:ignore only run in production
+			func Glue() { // *
+				println() // *
+			}             // *
+			`,
+	}
+	testSetup(t, func(s *shared.Setup) { s.Audit = true }, tests)
 
-		if err := cm.LoadProgram(); err != nil {
-			t.Fatalf("Error loading program in %s: %+v", name, err)
+	failures := map[string]string{
+		"no reason": `package foo
+			
+			func Baz(i int) int {
+				// notest
+				return i
+			}
+			`,
+		"no reason with expiry": `package foo
+			
+			func Baz(i int) int {
+				// notest(2999-01-01)
+				return i
+			}
+			`,
+		"expired": `package foo
+			
+			func Baz(i int) int {
+				// notest(2001-01-01): waiting on upstream fix
+				return i
+			}
+			`,
+		"ignore without reason": `package foo
+			
+			//courtney:ignore
+			func Baz(i int) int {
+				return i
+			}
+			`,
+		"begin without reason": `package foo
+			
+			func Baz(i int) int {
+				// notest:begin
+				i++
+				// notest:end
+				return i
+			}
+			`,
+	}
+	for name, source := range failures {
+		cm, _ := load(t, name, func(s *shared.Setup) { s.Audit = true }, source)
+		if err := cm.ScanPackages(); err == nil {
+			t.Fatalf("Expected error in %s", name)
 		}
+	}
 
-		if err := cm.ScanPackages(); err != nil {
-			t.Fatalf("Error scanning packages in %s: %+v", name, err)
+	// without the audit flag, expired and unexplained comments still apply
+	test(t, map[string]string{
+		"expired": `package foo
+			
+			func Baz(i int) int {
+				// notest(2001-01-01)
+				return i // *
+			}
+			`,
+	})
+
+	// without the audit flag, text in brackets that isn't a date is part of
+	// the reason
+	test(t, map[string]string{
+		"invalid date": `package foo
+			
+			func Baz(i int) int {
+				// notest(2001-13-01): reason
+				return i // *
+			}
+			`,
+		"bracketed reason": `package foo
+			
+			func Baz(i int) int {
+				// notest(legacy reasons) // *
+				return i // *
+			}
+			`,
+		"no closing bracket": `package foo
+			
+			func Baz(i int) int {
+				// notest(legacy reasons // *
+				return i // *
+			}
+			`,
+	})
+
+	// with the audit flag it's an error
+	for name, source := range map[string]string{
+		"invalid date": `package foo
+			
+			func Baz(i int) int {
+				// notest(2001-13-01): reason
+				return i
+			}
+			`,
+		"bracketed reason": `package foo
+			
+			func Baz(i int) int {
+				// notest(legacy reasons) // *
+				return i
+			}
+			`,
+	} {
+		cm, _ := load(t, name, func(s *shared.Setup) { s.Audit = true }, source)
+		if err := cm.ScanPackages(); err == nil {
+			t.Fatalf("Expected error in %s", name)
 		}
+	}
+}
+
+func TestDirectives(t *testing.T) {
+	tests := map[string]string{
+		"spellings": `package foo
+			
+			func Baz(i int) int {
+				if i > 1 {
+					//coverage:ignore // *
+					return i // *
+				}
+				if i > 2 {
+					// coverage-ignore // *
+					return i // *
+				}
+				if i > 3 {
+					/* notest */ // *
+					return i // *
+				}
+				if i > 4 {
+					/* coverage:ignore: glue code */ // *
+					return i // *
+				}
+				i++ //coverage:ignore // *
+				return 0
+			}
+			`,
+		"range": `package foo
+			
+			func Baz(i int) int {
+				// coverage:ignore:begin // *
+				i++ // *
+				// coverage:ignore:end // *
+				return i
+			}
+			`,
+		"not configured": `package foo
+			
+			func Baz(i int) int {
+				if i > 1 {
+					// coverage:skip
+					return i
+				}
+				return 0
+			}
+			`,
+	}
+	testSetup(t, func(s *shared.Setup) {
+		s.Directives = []string{"coverage:ignore", "coverage-ignore"}
+	}, tests)
+}
+
+func test(t *testing.T, tests map[string]string) {
+	testSetup(t, nil, tests)
+}
+
+func testSetup(t *testing.T, configure func(*shared.Setup), tests map[string]string) {
+	for name, source := range tests {
+		cm, pdir := scan(t, name, configure, source)
 
 		result := cm.Excludes[filepath.Join(pdir, "a.go")]
 
@@ -743,7 +3486,10 @@ func test(t *testing.T, tests map[string]string) {
 		//   - // notest$
 		//   - //notest // because this is glue code$
 		//   - // notest // because this is glue code$
-		notest := regexp.MustCompile("//\\s?notest(\\s//\\s?.*)?$")
+		//   - // notest:begin$
+		//   - // notest:end$
+		//   - // notest(2027-03-01): waiting on upstream fix$
+		notest := regexp.MustCompile("//\\s?notest(:begin|:end)?(\\([0-9-]+\\))?((:|\\s//)\\s?.*)?$")
 
 		for i, line := range strings.Split(source, "\n") {
 			expected := strings.HasSuffix(line, "// *") || notest.MatchString(line)
@@ -0,0 +1,104 @@
+package shared
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultConfig is the name of the config file that is loaded from the working
+// dir when no config file is specified
+const DefaultConfig = ".courtney.json"
+
+// Config is the format of the config file
+type Config struct {
+	Rules       map[Rule]bool `json:"rules"`
+	Terminators []string      `json:"terminators"`
+	Directives  []string      `json:"directives"`
+	Audit       bool          `json:"audit"`
+	Strict      bool          `json:"strict"`
+	Sinks       Sinks         `json:"sinks"`
+	GOOS        string        `json:"goos"`
+	GOARCH      string        `json:"goarch"`
+	Patterns    []string      `json:"patterns"`
+}
+
+// Sinks lists the places a non-nil error can be sent instead of being
+// returned. A block that ends by sending an error tested to be non-nil to a
+// sink is excluded in the same way as a block returning it.
+type Sinks struct {
+	// Functions lists functions that accept an error, in the form returned by
+	// types.Func.FullName e.g. "net/http.Error" or "(*log.Logger).Println". The
+	// error may be passed directly, wrapped, or as err.Error().
+	Functions []string `json:"functions"`
+	// Channels accepts sending the error on a channel e.g. errCh <- err
+	Channels bool `json:"channels"`
+	// Append accepts appending the error to a slice e.g.
+	// errs = append(errs, err)
+	Append bool `json:"append"`
+}
+
+// LoadConfig loads the config file and merges it into the setup. Settings
+// already present in the setup (e.g. from command line flags) take precedence.
+func (s *Setup) LoadConfig() error {
+	wd, err := s.Env.Getwd()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	fpath := s.Config
+	if fpath == "" {
+		fpath = filepath.Join(wd, DefaultConfig)
+		if _, err := os.Stat(fpath); os.IsNotExist(err) {
+			return nil
+		}
+	} else if !filepath.IsAbs(fpath) {
+		fpath = filepath.Join(wd, fpath)
+	}
+	b, err := os.ReadFile(fpath)
+	if err != nil {
+		return errors.Wrapf(err, "Error reading config file %s", fpath)
+	}
+	var c Config
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&c); err != nil {
+		return errors.Wrapf(err, "Error decoding config file %s", fpath)
+	}
+
+	for rule, enabled := range c.Rules {
+		if _, ok := s.Rules[rule]; ok {
+			continue
+		}
+		if s.Rules == nil {
+			s.Rules = make(map[Rule]bool)
+		}
+		s.Rules[rule] = enabled
+	}
+	s.Terminators = append(s.Terminators, c.Terminators...)
+	s.Directives = append(s.Directives, c.Directives...)
+	s.merge("audit", &s.Audit, c.Audit)
+	s.merge("strict", &s.Strict, c.Strict)
+	s.Sinks.Functions = append(s.Sinks.Functions, c.Sinks.Functions...)
+	s.merge("sinks.channels", &s.Sinks.Channels, c.Sinks.Channels)
+	s.merge("sinks.append", &s.Sinks.Append, c.Sinks.Append)
+	s.Patterns = append(s.Patterns, c.Patterns...)
+	if s.GOOS == "" {
+		s.GOOS = c.GOOS
+	}
+	if s.GOARCH == "" {
+		s.GOARCH = c.GOARCH
+	}
+	return nil
+}
+
+// merge turns on a boolean setting if it's on in the config file, unless the
+// setting was set explicitly
+func (s *Setup) merge(name string, value *bool, config bool) {
+	if s.Explicit[name] {
+		return
+	}
+	*value = *value || config
+}
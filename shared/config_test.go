@@ -0,0 +1,121 @@
+package shared_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dave/courtney/shared"
+	"github.com/dave/patsy/vos"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	config := `{
+		"rules": {"cancel": true, "error": true},
+		"terminators": ["k8s.io/klog/v2.Fatalf"],
+		"directives": ["coverage:ignore"],
+		"strict": true,
+		"sinks": {
+			"functions": ["net/http.Error"],
+			"channels": true
+		},
+		"patterns": ["metrics.Inc($_)"]
+	}`
+	if err := os.WriteFile(filepath.Join(dir, shared.DefaultConfig), []byte(config), 0666); err != nil {
+		t.Fatal(err)
+	}
+	env := vos.Mock()
+	if err := env.Setwd(dir); err != nil {
+		t.Fatal(err)
+	}
+	setup := &shared.Setup{
+		Env:         env,
+		Rules:       map[shared.Rule]bool{shared.RuleError: false},
+		Terminators: []string{"example.com/must.Die"},
+	}
+	if err := setup.LoadConfig(); err != nil {
+		t.Fatalf("Error loading config: %+v", err)
+	}
+	expected := &shared.Setup{
+		Env:         env,
+		Rules:       map[shared.Rule]bool{shared.RuleError: false, shared.RuleCancel: true},
+		Terminators: []string{"example.com/must.Die", "k8s.io/klog/v2.Fatalf"},
+		Directives:  []string{"coverage:ignore"},
+		Strict:      true,
+		Sinks: shared.Sinks{
+			Functions: []string{"net/http.Error"},
+			Channels:  true,
+		},
+		Patterns: []string{"metrics.Inc($_)"},
+	}
+	if !reflect.DeepEqual(setup, expected) {
+		t.Fatalf("Unexpected setup - got:\n%#v\nexpected:\n%#v\n", setup, expected)
+	}
+}
+
+func TestLoadConfig_explicit(t *testing.T) {
+	dir := t.TempDir()
+	config := `{
+		"audit": true,
+		"strict": true,
+		"sinks": {"channels": true, "append": true}
+	}`
+	if err := os.WriteFile(filepath.Join(dir, shared.DefaultConfig), []byte(config), 0666); err != nil {
+		t.Fatal(err)
+	}
+	env := vos.Mock()
+	if err := env.Setwd(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// settings that were set explicitly e.g. -audit=false aren't overridden
+	explicit := map[string]bool{"audit": true, "strict": true, "sinks.append": true}
+	setup := &shared.Setup{Env: env, Explicit: explicit}
+	if err := setup.LoadConfig(); err != nil {
+		t.Fatalf("Error loading config: %+v", err)
+	}
+	expected := &shared.Setup{
+		Env:      env,
+		Sinks:    shared.Sinks{Channels: true},
+		Explicit: explicit,
+	}
+	if !reflect.DeepEqual(setup, expected) {
+		t.Fatalf("Unexpected setup - got:\n%#v\nexpected:\n%#v\n", setup, expected)
+	}
+}
+
+func TestLoadConfig_missing(t *testing.T) {
+	env := vos.Mock()
+	if err := env.Setwd(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the default config file is optional
+	setup := &shared.Setup{Env: env}
+	if err := setup.LoadConfig(); err != nil {
+		t.Fatalf("Error loading config: %+v", err)
+	}
+
+	// a config file that is specified must exist
+	setup = &shared.Setup{Env: env, Config: "courtney.json"}
+	if err := setup.LoadConfig(); err == nil {
+		t.Fatal("Expected error loading missing config file")
+	}
+}
+
+func TestLoadConfig_invalid(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "courtney.json"), []byte(`{"foo": true}`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	env := vos.Mock()
+	if err := env.Setwd(dir); err != nil {
+		t.Fatal(err)
+	}
+	setup := &shared.Setup{Env: env, Config: "courtney.json"}
+	if err := setup.LoadConfig(); err == nil {
+		t.Fatal("Expected error loading invalid config file")
+	}
+}
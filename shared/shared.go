@@ -5,6 +5,7 @@ import (
 
 	"github.com/dave/patsy"
 	"github.com/dave/patsy/vos"
+	"github.com/pkg/errors"
 )
 
 // Setup holds globals, environment and command line flags for the courtney
@@ -21,6 +22,44 @@ type Setup struct {
 	Output   string
 	TestArgs []string
 	Packages []PackageSpec
+	// Rules turns individual exclusion rules on or off. Rules missing from the
+	// map are set to their default state (see Defaults).
+	Rules map[Rule]bool
+	// Extra lists the names of rules added by programs embedding courtney.
+	// These are turned on by default.
+	Extra []Rule
+	// Terminators lists extra functions that end the program or goroutine,
+	// in the form returned by types.Func.FullName e.g. "k8s.io/klog/v2.Fatalf"
+	// or "(*example.com/must.Logger).Die".
+	Terminators []string
+	// Directives lists extra spellings of the notest directive e.g.
+	// "coverage:ignore". These are recognised in // and /* */ comments.
+	Directives []string
+	// Audit fails the run if a notest comment has no reason or has passed its
+	// expiry date
+	Audit bool
+	// Strict only excludes errors tested to be non-nil if they were returned by
+	// a call into another module or the standard library
+	Strict bool
+	// Sinks lists the places a non-nil error can be sent instead of being
+	// returned
+	Sinks Sinks
+	// GOOS and GOARCH are the platform used to evaluate comparisons of
+	// runtime.GOOS and runtime.GOARCH. If empty, the GOOS and GOARCH
+	// environment variables or the current platform are used.
+	GOOS   string
+	GOARCH string
+	// Patterns lists Go code with $name wildcards that is excluded wherever
+	// it matches e.g. "metrics.Inc($_)" or
+	// "if $x == nil { return $_, errNilInput }"
+	Patterns []string
+	// Config is the path of the config file. If empty, DefaultConfig is used
+	// if it exists in the working dir.
+	Config string
+	// Explicit lists the boolean settings that were set explicitly e.g. by a
+	// command line flag, by their name in the config file e.g. "audit" or
+	// "sinks.channels". The config file doesn't override these.
+	Explicit map[string]bool
 }
 
 // PackageSpec identifies a package by dir and path
@@ -29,6 +68,101 @@ type PackageSpec struct {
 	Path string
 }
 
+// Rule identifies an exclusion rule used by the scanner
+type Rule string
+
+const (
+	// RulePanic excludes blocks containing a panic
+	RulePanic Rule = "panic"
+	// RuleNotest excludes code marked with a notest comment
+	RuleNotest Rule = "notest"
+	// RuleError excludes blocks returning an error tested to be non-nil
+	RuleError Rule = "error"
+	// RuleExit excludes blocks calling a function that ends the program or
+	// goroutine e.g. log.Fatal or os.Exit
+	RuleExit Rule = "exit"
+	// RuleGenerated excludes files with a "Code generated ... DO NOT EDIT."
+	// header
+	RuleGenerated Rule = "generated"
+	// RuleCancel excludes select cases receiving from ctx.Done() that return
+	// ctx.Err()
+	RuleCancel Rule = "cancel"
+	// RuleRecover excludes recover() handlers in deferred functions
+	RuleRecover Rule = "recover"
+	// RuleExhaustive excludes the default clause of a switch that handles
+	// every constant of a named type
+	RuleExhaustive Rule = "exhaustive"
+	// RuleConstant excludes branches that can never run because their
+	// condition is a constant, or compares runtime.GOOS or runtime.GOARCH
+	// against a different platform
+	RuleConstant Rule = "constant"
+	// RuleDataflow follows the SSA form of each function to exclude returns of
+	// an error that is provably non-nil on every path reaching them
+	RuleDataflow Rule = "dataflow"
+	// RuleMain excludes func main() in package main
+	RuleMain Rule = "main"
+	// RuleInit excludes func init()
+	RuleInit Rule = "init"
+	// RuleDeprecated excludes functions with a "Deprecated:" paragraph in
+	// their doc comment
+	RuleDeprecated Rule = "deprecated"
+	// RuleTrivial excludes functions that return a field, a constant or a
+	// fmt.Sprintf call, and single statement String, Error and MarshalText
+	// methods
+	RuleTrivial Rule = "trivial"
+	// RulePattern excludes code matching one of the configured patterns
+	RulePattern Rule = "pattern"
+)
+
+// Defaults lists all the exclusion rules with their default state
+var Defaults = map[Rule]bool{
+	RulePanic:      true,
+	RuleNotest:     true,
+	RuleError:      true,
+	RuleExit:       true,
+	RuleGenerated:  true,
+	RuleCancel:     false,
+	RuleRecover:    true,
+	RuleExhaustive: false,
+	RuleConstant:   false,
+	RuleDataflow:   false,
+	RuleMain:       false,
+	RuleInit:       false,
+	RuleDeprecated: false,
+	RuleTrivial:    false,
+	RulePattern:    true,
+}
+
+// Enabled returns true if the rule is turned on
+func (s *Setup) Enabled(rule Rule) bool {
+	if enabled, ok := s.Rules[rule]; ok {
+		return enabled
+	}
+	if enabled, ok := Defaults[rule]; ok {
+		return enabled
+	}
+	return s.isExtra(rule)
+}
+
+// CheckRules returns an error if the Rules map contains an unknown rule
+func (s *Setup) CheckRules() error {
+	for rule := range s.Rules {
+		if _, ok := Defaults[rule]; !ok && !s.isExtra(rule) {
+			return errors.Errorf("unknown rule %q", rule)
+		}
+	}
+	return nil
+}
+
+func (s *Setup) isExtra(rule Rule) bool {
+	for _, r := range s.Extra {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+}
+
 // Parse parses a slice of strings into the Packages slice
 func (s *Setup) Parse(args []string) error {
 	if len(args) == 0 {